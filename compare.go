@@ -0,0 +1,146 @@
+package userutil
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subiz/header"
+)
+
+// compareCmps lists the comparators allowed for each type
+var compareCmps = map[string]map[string]bool{
+	"text":     {"eq": true, "neq": true},
+	"boolean":  {"eq": true, "neq": true},
+	"number":   {"eq": true, "neq": true, "lt": true, "gt": true, "lte": true, "gte": true},
+	"datetime": {"eq": true, "neq": true, "lt": true, "gt": true, "lte": true, "gte": true, "before": true, "after": true},
+}
+
+// compareOp returns the sub condition field holding a compare op and the op,
+// e.g: number, compare:lt,attr:invoice_amount
+func compareOp(cond *header.UserViewCondition) (string, string) {
+	ops := []struct{ field, op string }{
+		{"text", cond.GetText().GetOp()},
+		{"number", cond.GetNumber().GetOp()},
+		{"datetime", cond.GetDatetime().GetOp()},
+		{"boolean", cond.GetBoolean().GetOp()},
+	}
+	for _, o := range ops {
+		if name, _ := splitOp(o.op); name == "compare" {
+			return o.field, o.op
+		}
+	}
+	return "", ""
+}
+
+// compileCompare compiles a condition comparing its key with another key of
+// the same user, e.g: attr:paid_amount compare:lt,attr:invoice_amount. Both
+// keys must have the same type, a missing value never matches. Numbers
+// closer than Tolerance are equal, like for the eq and neq number ops
+func compileCompare(defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition) (*compiledLeaf, error) {
+	_, op := compareOp(cond)
+	_, args := splitOp(op)
+	if len(args) != 2 {
+		return nil, fmt.Errorf("compare requires a comparator and a key")
+	}
+	cmp, other := strings.TrimSpace(args[0]), strings.TrimSpace(args[1])
+
+	left, err := ResolveKey(cond.GetKey(), defM)
+	if err != nil {
+		return nil, err
+	}
+	right, err := ResolveKey(other, defM)
+	if err != nil {
+		return nil, err
+	}
+	if left.Type != right.Type {
+		return nil, fmt.Errorf("cannot compare %s %q with %s %q", left.Type, cond.GetKey(), right.Type, other)
+	}
+	if compareCmps[left.Type] == nil {
+		return nil, fmt.Errorf("%s values cannot be compared", left.Type)
+	}
+	if !compareCmps[left.Type][cmp] {
+		return nil, fmt.Errorf("cannot compare %s values with %q", left.Type, cmp)
+	}
+
+	m, err := newTextMatcher(cond.GetText())
+	if err != nil {
+		return nil, err
+	}
+
+	// format returns the value as compared, after transforms
+	format := func(v KeyValue) string {
+		switch left.Type {
+		case "number":
+			num := applyFloatTransform(v.Number, cond.GetNumber().GetTransforms())
+			return strconv.FormatFloat(num, 'f', -1, 64)
+		case "datetime":
+			return time.UnixMilli(v.Datetime).UTC().Format(time.RFC3339)
+		case "boolean":
+			return strconv.FormatBool(v.Boolean)
+		}
+		return m.normalize(v.Text)
+	}
+
+	leaf := &compiledLeaf{key: cond.GetKey(), op: op, operands: []string{other}}
+	leaf.match = func(ctx *EvalContext, u *header.User) bool {
+		a, b := left.Get(u), right.Get(u)
+		if !a.Found || !b.Found {
+			return false
+		}
+
+		var c int
+		switch left.Type {
+		case "number":
+			x := applyFloatTransform(a.Number, cond.GetNumber().GetTransforms())
+			y := applyFloatTransform(b.Number, cond.GetNumber().GetTransforms())
+			if math.Abs(x-y) >= Tolerance {
+				c = compareFloat(x, y)
+			}
+		case "datetime":
+			c = compareFloat(float64(a.Datetime), float64(b.Datetime))
+		default:
+			if format(a) != format(b) {
+				c = 1
+			}
+		}
+
+		switch cmp {
+		case "eq":
+			return c == 0
+		case "neq":
+			return c != 0
+		case "lt", "before":
+			return c < 0
+		case "gt", "after":
+			return c > 0
+		case "lte":
+			return c <= 0
+		case "gte":
+			return c >= 0
+		}
+		return false
+	}
+	leaf.values = func(ctx *EvalContext, u *header.User) []string {
+		vals := []string{}
+		for _, v := range []KeyValue{left.Get(u), right.Get(u)} {
+			if v.Found {
+				vals = append(vals, format(v))
+			}
+		}
+		return vals
+	}
+	return leaf, nil
+}
+
+func compareFloat(a, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+package userutil
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subiz/header"
+)
+
+func TestCompare(t *testing.T) {
+	defM := map[string]*header.AttributeDefinition{
+		"last_order_at":     {Key: "last_order_at", Type: "datetime"},
+		"last_contacted_at": {Key: "last_contacted_at", Type: "datetime"},
+		"paid_amount":       {Key: "paid_amount", Type: "number"},
+		"invoice_amount":    {Key: "invoice_amount", Type: "number"},
+	}
+	at := func(day int) string { return time.Date(2023, 7, day, 9, 0, 0, 0, time.UTC).Format(time.RFC3339) }
+	visit := func(source string) *header.Event {
+		return &header.Event{By: &header.By{Device: &header.Device{Utm: &header.Utm{Source: source}}}}
+	}
+	user := func(start, first string, attrs ...*header.Attribute) *header.User {
+		return &header.User{Id: "u1", StartContentView: visit(start), FirstContentView: visit(first), Attributes: attrs}
+	}
+
+	ordered := &header.UserViewCondition{Key: "attr:last_order_at", Datetime: &header.DatetimeCondition{Op: "compare:after,attr:last_contacted_at"}}
+	underpaid := &header.UserViewCondition{Key: "attr:paid_amount", Number: &header.FloatCondition{Op: "compare:lt,attr:invoice_amount"}}
+	settled := &header.UserViewCondition{Key: "attr:paid_amount", Number: &header.FloatCondition{Op: "compare:eq,attr:invoice_amount"}}
+	switched := &header.UserViewCondition{Key: "start_content_view:by:device:utm:source", Text: &header.TextCondition{Op: "compare:neq,first_content_view:by:device:utm:source"}}
+
+	cases := []struct {
+		cond *header.UserViewCondition
+		u    *header.User
+		want bool
+	}{
+		{ordered, user("", "", &header.Attribute{Key: "last_order_at", Datetime: at(12)}, &header.Attribute{Key: "last_contacted_at", Datetime: at(10)}), true},
+		{ordered, user("", "", &header.Attribute{Key: "last_order_at", Datetime: at(10)}, &header.Attribute{Key: "last_contacted_at", Datetime: at(12)}), false},
+		{ordered, user("", "", &header.Attribute{Key: "last_order_at", Datetime: at(10)}, &header.Attribute{Key: "last_contacted_at", Datetime: at(10)}), false},
+		{ordered, user("", "", &header.Attribute{Key: "last_order_at", Datetime: at(12)}), false},
+
+		{underpaid, user("", "", &header.Attribute{Key: "paid_amount", Number: 80}, &header.Attribute{Key: "invoice_amount", Number: 100}), true},
+		{underpaid, user("", "", &header.Attribute{Key: "paid_amount", Number: 100}, &header.Attribute{Key: "invoice_amount", Number: 100}), false},
+		{underpaid, user("", "", &header.Attribute{Key: "invoice_amount", Number: 100}), false},
+
+		// numbers closer than Tolerance are equal, like for the eq op
+		{underpaid, user("", "", &header.Attribute{Key: "paid_amount", Number: 0.1 + 0.2}, &header.Attribute{Key: "invoice_amount", Number: 0.3}), false},
+		{settled, user("", "", &header.Attribute{Key: "paid_amount", Number: 0.1 + 0.2}, &header.Attribute{Key: "invoice_amount", Number: 0.3}), true},
+		{settled, user("", "", &header.Attribute{Key: "paid_amount", Number: 0.3 + Tolerance*10}, &header.Attribute{Key: "invoice_amount", Number: 0.3}), false},
+
+		{switched, user("google", "Facebook"), true},
+		{switched, user("google", "Google"), false},
+	}
+
+	for i, c := range cases {
+		if got := RsCheck(nil, defM, c.u, c.cond, false); got != c.want {
+			t.Errorf("case %d, %s: got %v, want %v", i, c.cond.Key, got, c.want)
+		}
+	}
+
+	// the constant eq agrees with the compare eq
+	u := user("", "", &header.Attribute{Key: "paid_amount", Number: 0.1 + 0.2}, &header.Attribute{Key: "invoice_amount", Number: 0.3})
+	constant := &header.UserViewCondition{Key: "attr:paid_amount", Number: &header.FloatCondition{Op: "eq", Eq: []float64{0.3}}}
+	if RsCheck(nil, defM, u, constant, false) != RsCheck(nil, defM, u, settled, false) {
+		t.Error("want eq with a constant and with a key to agree")
+	}
+}
+
+func TestCompareTypeErrors(t *testing.T) {
+	defM := map[string]*header.AttributeDefinition{
+		"paid_amount":   {Key: "paid_amount", Type: "number"},
+		"last_order_at": {Key: "last_order_at", Type: "datetime"},
+		"vip":           {Key: "vip", Type: "boolean"},
+		"name":          {Key: "name", Type: "text"},
+	}
+	cases := map[string]*header.UserViewCondition{
+		`cannot compare number "attr:paid_amount" with datetime "attr:last_order_at"`: {Key: "attr:paid_amount", Number: &header.FloatCondition{Op: "compare:lt,attr:last_order_at"}},
+		`cannot compare text "attr:name" with number "attr:paid_amount"`:              {Key: "attr:name", Text: &header.TextCondition{Op: "compare:eq,attr:paid_amount"}},
+		`cannot compare boolean values with "lt"`:                                     {Key: "attr:vip", Boolean: &header.BoolCondition{Op: "compare:lt,attr:vip"}},
+		`cannot compare text values with "after"`:                                     {Key: "attr:name", Text: &header.TextCondition{Op: "compare:after,id"}},
+		`attribute "invoice_amount" is not defined`:                                   {Key: "attr:paid_amount", Number: &header.FloatCondition{Op: "compare:lt,attr:invoice_amount"}},
+		"compare requires a comparator and a key":                                     {Key: "attr:paid_amount", Number: &header.FloatCondition{Op: "compare:lt"}},
+	}
+	for want, cond := range cases {
+		if _, err := Compile(nil, defM, cond); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want %s, got %v", want, err)
+		}
+		if errs := ValidateCondition(defM, cond); len(errs) != 1 || !strings.Contains(errs[0].Message, want) {
+			t.Errorf("want %s, got %v", want, errs)
+		}
+	}
+}
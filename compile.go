@@ -0,0 +1,384 @@
+package userutil
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subiz/header"
+	apb "github.com/subiz/header/account"
+)
+
+// CompiledCondition is a UserViewCondition prepared for evaluating many
+// users: text operands are normalized, attribute definitions and key
+// accessors are resolved once in Compile instead of once per user
+type CompiledCondition struct {
+	deleted bool
+	root    *compiledNode
+}
+
+type compiledNode struct {
+	cond *header.UserViewCondition
+	not  *compiledNode
+	one  []*compiledNode
+	all  []*compiledNode
+	leaf *compiledLeaf
+}
+
+// NotKey is the key of a negation node, which matches when its group does
+// not, e.g: {key: "not", all: [A, B]} is NOT (A AND B). A negation of an
+// empty group never matches
+const NotKey = "not"
+
+// negated returns the group a negation node negates
+func negated(cond *header.UserViewCondition) *header.UserViewCondition {
+	return &header.UserViewCondition{One: cond.GetOne(), All: cond.GetAll()}
+}
+
+type compiledLeaf struct {
+	key      string
+	op       string
+	operands []string
+	match    func(ctx *EvalContext, u *header.User) bool
+
+	// values returns the user values the leaf compares, after transforms and
+	// folding, used to explain the evaluation
+	values func(ctx *EvalContext, u *header.User) []string
+}
+
+// Compile prepares cond for evaluating against many users of account acc.
+// The returned condition only matches deleted users if cond.Deleted is set
+func Compile(acc *apb.Account, defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition) (*CompiledCondition, error) {
+	return compile(acc, defM, cond, cond.GetDeleted())
+}
+
+func compile(acc *apb.Account, defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition, deleted bool) (*CompiledCondition, error) {
+	root, err := compileNode(acc, defM, cond)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledCondition{deleted: deleted, root: root}, nil
+}
+
+func compileNode(acc *apb.Account, defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition) (*compiledNode, error) {
+	node := &compiledNode{cond: cond}
+	if cond.GetKey() == NotKey {
+		not, err := compileNode(acc, defM, negated(cond))
+		if err != nil {
+			return nil, err
+		}
+		node.not = not
+		return node, nil
+	}
+
+	if len(cond.GetOne()) > 0 {
+		for _, c := range cond.GetOne() {
+			child, err := compileNode(acc, defM, c)
+			if err != nil {
+				return nil, err
+			}
+			node.one = append(node.one, child)
+		}
+		return node, nil
+	}
+
+	if len(cond.GetAll()) > 0 {
+		for _, c := range cond.GetAll() {
+			child, err := compileNode(acc, defM, c)
+			if err != nil {
+				return nil, err
+			}
+			node.all = append(node.all, child)
+		}
+		return node, nil
+	}
+
+	leaf, err := compileSingleCond(acc, defM, cond, true)
+	if err != nil {
+		return nil, err
+	}
+	node.leaf = leaf
+	return node, nil
+}
+
+// compileSingleCond compiles a leaf, index is set for leaves evaluated
+// against many users, see textMatcher.index
+func compileSingleCond(acc *apb.Account, defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition, index bool) (*compiledLeaf, error) {
+	if field, _ := compareOp(cond); field != "" {
+		return compileCompare(defM, cond)
+	}
+
+	key := cond.GetKey()
+	leaf := &compiledLeaf{key: key, op: cond.GetText().GetOp()}
+	resolver := lookupKey(key)
+	if resolver == nil {
+		leaf.match = func(ctx *EvalContext, u *header.User) bool { return true }
+		return leaf, nil
+	}
+
+	accessor, err := resolver(key, defM)
+	if err != nil {
+		// e.g: def not found
+		leaf.match = func(ctx *EvalContext, u *header.User) bool { return false }
+		return leaf, nil
+	}
+	get := accessor.Get
+
+	switch accessor.Type {
+	case "keyword":
+		keyword, has := keywordOperand(cond)
+		if !has {
+			leaf.match = func(ctx *EvalContext, u *header.User) bool { return true }
+			return leaf, nil
+		}
+		leaf.operands = []string{keyword}
+		leaf.match = func(ctx *EvalContext, u *header.User) bool {
+			for _, val := range get(u).List {
+				if strings.Contains(val, keyword) {
+					return true
+				}
+			}
+			return false
+		}
+		leaf.values = func(ctx *EvalContext, u *header.User) []string { return get(u).List }
+		return leaf, nil
+	case "list":
+		m, err := newTextMatcher(cond.GetText())
+		if err != nil {
+			return nil, err
+		}
+		if index {
+			m.index()
+		}
+		leaf.operands = m.explainOperands()
+		leaf.match = func(ctx *EvalContext, u *header.User) bool { return m.matchAll(get(u).List) }
+		if accessor.AnyValue && m.quantifier == "" && !setTextOps[m.op] {
+			leaf.match = func(ctx *EvalContext, u *header.User) bool { return m.matchAny(get(u).List) }
+		}
+		leaf.values = func(ctx *EvalContext, u *header.User) []string { return m.normalizeAll(get(u).List) }
+		return leaf, nil
+	case "text":
+		if cond.GetText() == nil && cond.GetNumber() != nil {
+			// text holding numbers, e.g: imported order_count
+			leaf.op = cond.GetNumber().GetOp()
+			leaf.operands = floatOperands(cond.GetNumber())
+			leaf.match = func(ctx *EvalContext, u *header.User) bool {
+				v := get(u)
+				num, ok := parseNumberText(v.Text)
+				return EvaluateFloat(v.Found && ok, num, cond.GetNumber())
+			}
+			leaf.values = func(ctx *EvalContext, u *header.User) []string {
+				v := get(u)
+				if num, ok := parseNumberText(v.Text); v.Found && ok {
+					num = applyFloatTransform(num, cond.GetNumber().GetTransforms())
+					return []string{strconv.FormatFloat(num, 'f', -1, 64)}
+				}
+				return nil
+			}
+			return leaf, nil
+		}
+
+		if cond.GetText() == nil && cond.GetDatetime() != nil {
+			// text holding dates
+			leaf.op = cond.GetDatetime().GetOp()
+			leaf.operands = datetimeOperands(cond.GetDatetime())
+			leaf.match = func(ctx *EvalContext, u *header.User) bool {
+				v := get(u)
+				date, ok := parseDatetimeText(v.Text, ctx.location(acc))
+				return EvaluateDatetimeAt(ctx, acc, v.Found && ok, date, cond.Datetime)
+			}
+			leaf.values = func(ctx *EvalContext, u *header.User) []string {
+				v := get(u)
+				if date, ok := parseDatetimeText(v.Text, ctx.location(acc)); v.Found && ok {
+					return []string{time.UnixMilli(date).UTC().Format(time.RFC3339)}
+				}
+				return nil
+			}
+			return leaf, nil
+		}
+
+		m, err := newTextMatcher(cond.GetText())
+		if err != nil {
+			return nil, err
+		}
+		if index {
+			m.index()
+		}
+		leaf.operands = m.explainOperands()
+		if split := accessor.Split; split != nil && (m.quantifier != "" || setTextOps[m.op]) {
+			values := func(u *header.User) []string {
+				if v := get(u); v.Found {
+					return split(v.Text)
+				}
+				return nil
+			}
+			leaf.match = func(ctx *EvalContext, u *header.User) bool { return m.matchAll(values(u)) }
+			leaf.values = func(ctx *EvalContext, u *header.User) []string { return m.normalizeAll(values(u)) }
+			return leaf, nil
+		}
+		leaf.match = func(ctx *EvalContext, u *header.User) bool {
+			v := get(u)
+			return m.match(v.Found, v.Text)
+		}
+		leaf.values = func(ctx *EvalContext, u *header.User) []string {
+			if v := get(u); v.Found {
+				return []string{m.normalize(v.Text)}
+			}
+			return nil
+		}
+		return leaf, nil
+	case "number":
+		leaf.op = cond.GetNumber().GetOp()
+		leaf.operands = floatOperands(cond.GetNumber())
+		leaf.match = func(ctx *EvalContext, u *header.User) bool {
+			v := get(u)
+			return EvaluateFloat(v.Found, v.Number, cond.GetNumber())
+		}
+		leaf.values = func(ctx *EvalContext, u *header.User) []string {
+			if v := get(u); v.Found {
+				num := applyFloatTransform(v.Number, cond.GetNumber().GetTransforms())
+				return []string{strconv.FormatFloat(num, 'f', -1, 64)}
+			}
+			return nil
+		}
+		return leaf, nil
+	case "boolean":
+		leaf.op = cond.GetBoolean().GetOp()
+		leaf.match = func(ctx *EvalContext, u *header.User) bool {
+			v := get(u)
+			return EvaluateBool(v.Found, v.Boolean, cond.GetBoolean())
+		}
+		leaf.values = func(ctx *EvalContext, u *header.User) []string {
+			if v := get(u); v.Found {
+				return []string{strconv.FormatBool(v.Boolean)}
+			}
+			return nil
+		}
+		return leaf, nil
+	case "datetime": // consider number in ms
+		leaf.op = cond.GetDatetime().GetOp()
+		leaf.operands = datetimeOperands(cond.GetDatetime())
+		leaf.match = func(ctx *EvalContext, u *header.User) bool {
+			v := get(u)
+			return EvaluateDatetimeAt(ctx, acc, v.Found, v.Datetime, cond.Datetime)
+		}
+		leaf.values = func(ctx *EvalContext, u *header.User) []string {
+			if v := get(u); v.Found {
+				return []string{time.UnixMilli(v.Datetime).UTC().Format(time.RFC3339)}
+			}
+			return nil
+		}
+		return leaf, nil
+	}
+	leaf.match = func(ctx *EvalContext, u *header.User) bool { return true }
+	return leaf, nil
+}
+
+// Match tells whether user u satisfies the compiled condition at the current
+// time
+func (c *CompiledCondition) Match(u *header.User) bool {
+	return c.MatchAt(&EvalContext{Now: time.Now()}, u)
+}
+
+// MatchAt tells whether user u satisfies the compiled condition as of ctx.Now
+func (c *CompiledCondition) MatchAt(ctx *EvalContext, u *header.User) bool {
+	if c.deleted && u.Deleted == 0 {
+		return false
+	}
+
+	if !c.deleted && u.Deleted > 0 {
+		return false
+	}
+	return c.root.match(ctx, u)
+}
+
+func (n *compiledNode) match(ctx *EvalContext, u *header.User) bool {
+	if n.not != nil {
+		return !n.not.match(ctx, u)
+	}
+
+	if len(n.one) > 0 {
+		for _, c := range n.one {
+			if c.match(ctx, u) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(n.all) > 0 {
+		for _, c := range n.all {
+			if !c.match(ctx, u) {
+				return false
+			}
+		}
+		return true
+	}
+	return n.leaf.match(ctx, u)
+}
+
+// RsCheck tells whether user u satisfies cond, a condition which fails to
+// compile, e.g: an invalid regex, never matches. Leaves are compiled as they
+// are evaluated and groups stop at the first deciding child, callers
+// evaluating the same condition against many users should Compile it once
+// instead
+func RsCheck(acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User, cond *header.UserViewCondition, deleted bool) bool {
+	ok, _ := RsCheckAt(&EvalContext{Now: time.Now()}, acc, defM, u, cond, deleted)
+	return ok
+}
+
+// RsCheckAt is RsCheck evaluated as of ctx.Now, returning the error of the
+// first leaf which fails to compile among the ones evaluated. Use Compile or
+// ValidateCondition to check the whole condition
+func RsCheckAt(ctx *EvalContext, acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User, cond *header.UserViewCondition, deleted bool) (bool, error) {
+	if deleted && u.Deleted == 0 {
+		return false, nil
+	}
+
+	if !deleted && u.Deleted > 0 {
+		return false, nil
+	}
+	return rsCheck(ctx, acc, defM, u, cond)
+}
+
+func rsCheck(ctx *EvalContext, acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User, cond *header.UserViewCondition) (bool, error) {
+	if cond.GetKey() == NotKey {
+		ok, err := rsCheck(ctx, acc, defM, u, negated(cond))
+		if err != nil {
+			return false, err
+		}
+		return !ok, nil
+	}
+
+	if len(cond.GetOne()) > 0 {
+		for _, c := range cond.GetOne() {
+			ok, err := rsCheck(ctx, acc, defM, u, c)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if len(cond.GetAll()) > 0 {
+		for _, c := range cond.GetAll() {
+			ok, err := rsCheck(ctx, acc, defM, u, c)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	leaf, err := compileSingleCond(acc, defM, cond, false)
+	if err != nil {
+		return false, err
+	}
+	return leaf.match(ctx, u), nil
+}
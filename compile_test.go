@@ -0,0 +1,230 @@
+package userutil
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/subiz/header"
+)
+
+func TestRsCheckMatchesCompile(t *testing.T) {
+	ctx := &EvalContext{Now: time.Date(2023, 7, 12, 10, 0, 0, 0, time.UTC)}
+	defM := map[string]*header.AttributeDefinition{
+		"name":  {Key: "name", Type: "text"},
+		"score": {Key: "score", Type: "number"},
+	}
+	users := []*header.User{
+		{Id: "u1", Attributes: []*header.Attribute{{Key: "name", Text: "Thành Nguyễn"}, {Key: "score", Number: 7}}},
+		{Id: "u2", Attributes: []*header.Attribute{{Key: "name", Text: "Lan"}}},
+		{Id: "u3", Deleted: 1, Attributes: []*header.Attribute{{Key: "name", Text: "thanh"}}},
+	}
+	many := []string{"Lan"}
+	for i := 0; i < SetThreshold; i++ {
+		many = append(many, "name "+strconv.Itoa(i))
+	}
+	conds := []*header.UserViewCondition{
+		{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: many}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "neq", Neq: many}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "not_in_set", Neq: many[:2]}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "contain", Contain: []string{"thanh"}}},
+		{Key: "attr:score", Number: &header.FloatCondition{Op: "gt", Gt: 5}},
+		{One: []*header.UserViewCondition{
+			{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan"}}},
+			{Key: "attr:score", Number: &header.FloatCondition{Op: "has_value"}},
+		}},
+		{Key: NotKey, All: []*header.UserViewCondition{
+			{Key: "attr:name", Text: &header.TextCondition{Op: "start_with", StartWith: []string{"th"}}},
+		}},
+		{Key: "attr:missing", Text: &header.TextCondition{Op: "has_value"}},
+		{Key: "unknown", Text: &header.TextCondition{Op: "has_value"}},
+	}
+
+	for i, cond := range conds {
+		for _, deleted := range []bool{false, true} {
+			compiled, err := compile(nil, defM, cond, deleted)
+			if err != nil {
+				t.Fatalf("cond %d: %v", i, err)
+			}
+			for _, u := range users {
+				ok, err := RsCheckAt(ctx, nil, defM, u, cond, deleted)
+				if err != nil {
+					t.Fatalf("cond %d: %v", i, err)
+				}
+				if want := compiled.MatchAt(ctx, u); ok != want {
+					t.Errorf("cond %d, deleted %v, user %s: RsCheckAt %v, Compile %v", i, deleted, u.Id, ok, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRsCheckReturnsCompileErrors(t *testing.T) {
+	u := &header.User{Id: "u1", Attributes: []*header.Attribute{{Key: "name", Text: "Lan"}}}
+	defM := map[string]*header.AttributeDefinition{"name": {Key: "name", Type: "text"}}
+	invalid := &header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "regex", Regex: "(lan"}}
+
+	if ok, err := RsCheckAt(&EvalContext{}, nil, defM, u, invalid, false); ok || err == nil {
+		t.Errorf("want an error, got %v, %v", ok, err)
+	}
+	if RsCheck(nil, defM, u, invalid, false) {
+		t.Error("an invalid condition must not match")
+	}
+
+	// groups stop at the first deciding child
+	cond := &header.UserViewCondition{One: []*header.UserViewCondition{
+		{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan"}}},
+		invalid,
+	}}
+	if ok, err := RsCheckAt(&EvalContext{}, nil, defM, u, cond, false); !ok || err != nil {
+		t.Errorf("want a match, got %v, %v", ok, err)
+	}
+
+	users, err := PureFilterUsersAt(&EvalContext{}, nil, invalid, []*header.User{u}, "", 10, "", defM, nil)
+	if err == nil || users != nil {
+		t.Errorf("want an error, got %v, %v", users, err)
+	}
+}
+
+func TestOwnerKeysMatchAnyValue(t *testing.T) {
+	two := &header.User{Id: "u1", LeadOwners: []string{"ag1", "ag2"}}
+	none := &header.User{Id: "u2"}
+	cases := []struct {
+		text        *header.TextCondition
+		two, noneOk bool
+	}{
+		// without a quantifier any owner decides, as before
+		{&header.TextCondition{Op: "eq", Eq: []string{"ag1"}}, true, false},
+		{&header.TextCondition{Op: "neq", Neq: []string{"ag1"}}, true, true},
+		{&header.TextCondition{Op: "neq", Neq: []string{"ag1", "ag2"}}, false, true},
+		{&header.TextCondition{Op: "not_contain", NotContain: []string{"ag2"}}, true, false},
+		{&header.TextCondition{Op: "has_value"}, true, false},
+		{&header.TextCondition{Op: "is_empty"}, false, true},
+
+		// quantifiers evaluate the owners as a list
+		{&header.TextCondition{Op: "all/neq", Neq: []string{"ag1"}}, false, false},
+		{&header.TextCondition{Op: "none/eq", Eq: []string{"ag1"}}, false, true},
+		{&header.TextCondition{Op: "exactly:2/has_value"}, true, false},
+	}
+
+	for _, c := range cases {
+		for _, key := range []string{"lead_owners", "lead_conversion_bys"} {
+			cond := &header.UserViewCondition{Key: key, Text: c.text}
+			u, empty := two, none
+			if key == "lead_conversion_bys" {
+				u = &header.User{Id: "u1", LeadConversionBys: two.LeadOwners}
+			}
+			if got := RsCheck(nil, nil, u, cond, false); got != c.two {
+				t.Errorf("%s %s on two owners: got %v, want %v", key, c.text.Op, got, c.two)
+			}
+			if got := RsCheck(nil, nil, empty, cond, false); got != c.noneOk {
+				t.Errorf("%s %s on no owner: got %v, want %v", key, c.text.Op, got, c.noneOk)
+			}
+		}
+	}
+}
+
+func TestListAttributes(t *testing.T) {
+	defM := map[string]*header.AttributeDefinition{"interests": {Key: "interests", Type: "list"}}
+	u := &header.User{Id: "u1", Attributes: []*header.Attribute{{Key: "interests", Text: "golf, Tennis"}}}
+	json := &header.User{Id: "u2", Attributes: []*header.Attribute{{Key: "interests", Text: `["golf","tennis"]`}}}
+	none := &header.User{Id: "u3"}
+	cases := []struct {
+		text          *header.TextCondition
+		u, json, none bool
+	}{
+		// without a quantifier nor a set op the list is a text, as before
+		{&header.TextCondition{Op: "eq", Eq: []string{"golf, tennis"}}, true, false, false},
+		{&header.TextCondition{Op: "eq", Eq: []string{"golf"}}, false, false, false},
+		{&header.TextCondition{Op: "contain", Contain: []string{"tennis"}}, true, true, false},
+		{&header.TextCondition{Op: "has_value"}, true, true, false},
+
+		// set ops and quantifiers decode the values
+		{&header.TextCondition{Op: "contains_all", Eq: []string{"tennis", "golf"}}, true, true, false},
+		{&header.TextCondition{Op: "equals_set", Eq: []string{"golf", "tennis"}}, true, true, false},
+		{&header.TextCondition{Op: "contains_none", Eq: []string{"chess"}}, true, true, true},
+		{&header.TextCondition{Op: "size_eq:2"}, true, true, false},
+		{&header.TextCondition{Op: "any/eq", Eq: []string{"golf"}}, true, true, false},
+		{&header.TextCondition{Op: "all/start_with", StartWith: []string{"t"}}, true, true, false},
+		{&header.TextCondition{Op: "all/start_with", StartWith: []string{"t", "c"}}, false, false, false},
+	}
+
+	for _, c := range cases {
+		cond := &header.UserViewCondition{Key: "attr:interests", Text: c.text}
+		for _, uc := range []struct {
+			u    *header.User
+			want bool
+		}{{u, c.u}, {json, c.json}, {none, c.none}} {
+			if got := RsCheck(nil, defM, uc.u, cond, false); got != uc.want {
+				t.Errorf("%s on %s: got %v, want %v", c.text.Op, uc.u.Id, got, uc.want)
+			}
+		}
+	}
+
+	if got := GetSortVal("attr:interests", u, defM); got != "sgolf, Tennis" {
+		t.Errorf("sort value: got %q", got)
+	}
+}
+
+func TestAllQuantifier(t *testing.T) {
+	labels := func(names ...string) *header.User {
+		u := &header.User{Id: "u1"}
+		for _, name := range names {
+			u.Labels = append(u.Labels, &header.Label{Label: name})
+		}
+		return u
+	}
+	cases := []struct {
+		text *header.TextCondition
+		u    *header.User
+		want bool
+	}{
+		// every operand is matched by some value, however many operands
+		{&header.TextCondition{Op: "all/eq", Eq: []string{"VIP", "Paid"}}, labels("VIP", "Paid", "Trial"), true},
+		{&header.TextCondition{Op: "all/eq", Eq: []string{"VIP"}}, labels("VIP", "Trial"), true},
+		{&header.TextCondition{Op: "all/eq", Eq: []string{"VIP"}}, labels("Trial"), false},
+		{&header.TextCondition{Op: "all/eq", Eq: []string{"VIP", "Paid"}}, labels("VIP", "Trial"), false},
+		{&header.TextCondition{Op: "all/contain", Contain: []string{"vi"}}, labels("VIP", "Trial"), true},
+		{&header.TextCondition{Op: "all/eq", Eq: []string{"VIP"}}, labels(), false},
+
+		// without operand or with a negated op every value matches
+		{&header.TextCondition{Op: "all/has_value"}, labels("VIP", "Trial"), true},
+		{&header.TextCondition{Op: "all/neq", Neq: []string{"Trial"}}, labels("VIP", "Trial"), false},
+		{&header.TextCondition{Op: "all/neq", Neq: []string{"Paid"}}, labels("VIP", "Trial"), true},
+	}
+
+	for _, c := range cases {
+		cond := &header.UserViewCondition{Key: "labels", Text: c.text}
+		if got := RsCheck(nil, nil, c.u, cond, false); got != c.want {
+			t.Errorf("%s %v on %d labels: got %v, want %v", c.text.Op, textOperands(c.text, textOperandField(c.text.Op)), len(c.u.Labels), got, c.want)
+		}
+	}
+}
+
+func TestKeyword(t *testing.T) {
+	u := &header.User{Id: "U1", Attributes: []*header.Attribute{{Key: "fullname", Text: "Thành Nguyễn"}, {Key: "phone", Text: "0912 345 678"}}}
+	for keyword, want := range map[string]bool{
+		"thanh ng": true, "0912345": true, "u1": true, "lan": false, "": true,
+	} {
+		cond := &header.UserViewCondition{Key: "keyword", Text: &header.TextCondition{Op: "contain"}}
+		if keyword != "" {
+			cond.Text.Contain = []string{keyword}
+		}
+		if got := RsCheck(nil, nil, u, cond, false); got != want {
+			t.Errorf("%q: got %v, want %v", keyword, got, want)
+		}
+	}
+}
+
+func TestListSortValues(t *testing.T) {
+	u := &header.User{
+		Id:         "u1",
+		Labels:     []*header.Label{{Label: "b"}, {Label: "a"}},
+		LeadOwners: []string{"ag1", "ag2"},
+	}
+	for key, want := range map[string]string{"labels": "l2.ba", "lead_owners": "l2.ag1,ag2", "-id": "su1"} {
+		if got := GetSortVal(key, u, nil); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package userutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/subiz/goutils/business_hours"
+	apb "github.com/subiz/header/account"
+)
+
+var locationCache sync.Map // tz => *time.Location
+
+// LoadTimezone converts an account timezone, either an offset (+07:00) or an
+// IANA name (Asia/Ho_Chi_Minh), to a location. Invalid timezones fall back
+// to UTC. IANA names are read from the system zoneinfo, programs running
+// without one should import time/tzdata
+func LoadTimezone(tz string) *time.Location {
+	if loc, has := locationCache.Load(tz); has {
+		return loc.(*time.Location)
+	}
+
+	var loc *time.Location
+	if h, m, err := business_hours.SplitTzOffset(tz); err == nil {
+		loc = time.FixedZone(tz, h*3600+m*60)
+	} else if l, err := time.LoadLocation(tz); err == nil {
+		loc = l
+	} else {
+		loc = time.UTC
+	}
+	locationCache.Store(tz, loc)
+	return loc
+}
+
+func (ctx *EvalContext) location(acc *apb.Account) *time.Location {
+	if ctx != nil && ctx.Location != nil {
+		return ctx.Location
+	}
+	return LoadTimezone(acc.GetTimezone())
+}
+
+// weekStart returns the first day of the week, ctx.WeekStart, weeks start
+// on Monday when unset
+func (ctx *EvalContext) weekStart() time.Weekday {
+	if ctx != nil {
+		if day, ok := parseWeekday(ctx.WeekStart); ok {
+			return day
+		}
+	}
+	return time.Monday
+}
+
+// parseWeekday accepts a weekday number (0 is Sunday) or an english weekday
+// name, e.g: sunday, Mon
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || n > 6 {
+			return 0, false
+		}
+		return time.Weekday(n), true
+	}
+
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) || strings.EqualFold(s, d.String()[:3]) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// fiscalYearStart returns the first month of the fiscal year,
+// ctx.FiscalYearStartMonth, fiscal years start in January when unset
+func (ctx *EvalContext) fiscalYearStart() time.Month {
+	if ctx != nil && ctx.FiscalYearStartMonth >= time.January && ctx.FiscalYearStartMonth <= time.December {
+		return ctx.FiscalYearStartMonth
+	}
+	return time.January
+}
+
+// tzOffset formats the offset of t's location at t, e.g: +07:00, as expected
+// by business_hours
+func tzOffset(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// inPeriod tells whether t is in [start, end)
+func inPeriod(t, start, end time.Time) bool {
+	return !t.Before(start) && t.Before(end)
+}
+
+// startOfDay returns midnight of t's day in t's location, days are not
+// always 24 hours long around DST transitions
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func startOfWeek(t time.Time, weekstart time.Weekday) time.Time {
+	days := (int(t.Weekday()) - int(weekstart) + 7) % 7
+	return startOfDay(t).AddDate(0, 0, -days)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// startOfYear returns the first day of the year containing t, for years
+// starting on month yearstart
+func startOfYear(t time.Time, yearstart time.Month) time.Time {
+	year := t.Year()
+	if t.Month() < yearstart {
+		year--
+	}
+	return time.Date(year, yearstart, 1, 0, 0, 0, 0, t.Location())
+}
+
+// startOfQuarter returns the first day of the quarter containing t, for
+// years starting on month yearstart
+func startOfQuarter(t time.Time, yearstart time.Month) time.Time {
+	months := (int(t.Month()) - int(yearstart) + 12) % 12
+	return startOfYear(t, yearstart).AddDate(0, months/3*3, 0)
+}
+
+// anniversary returns the start of t's anniversary day in year, anniversaries
+// of February 29 fall on February 28 in non-leap years
+func anniversary(t time.Time, year int) time.Time {
+	day := t.Day()
+	if t.Month() == time.February && day == 29 && !isLeap(year) {
+		day = 28
+	}
+	return time.Date(year, t.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+func sameDay(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.Month() == b.Month() && a.Day() == b.Day()
+}
+
+// daysBetween counts calendar days from a to b, ignoring DST shifts
+func daysBetween(a, b time.Time) int {
+	da := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	db := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(db.Sub(da).Hours() / 24)
+}
+
+// parseMonth accepts a month number (1-12) or an english month name
+func parseMonth(s string) (time.Month, bool) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 || n > 12 {
+			return 0, false
+		}
+		return time.Month(n), true
+	}
+
+	for m := time.January; m <= time.December; m++ {
+		if strings.EqualFold(s, m.String()) || strings.EqualFold(s, m.String()[:3]) {
+			return m, true
+		}
+	}
+	return 0, false
+}
+
+// parseClock converts a time of day, e.g: 18:30, to minutes since midnight
+func parseClock(s string) (int, bool) {
+	hour, min, found := strings.Cut(strings.TrimSpace(s), ":")
+	if !found {
+		return 0, false
+	}
+	h, err := strconv.Atoi(hour)
+	if err != nil || h < 0 || h > 23 {
+		return 0, false
+	}
+	m, err := strconv.Atoi(min)
+	if err != nil || m < 0 || m > 59 {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+// businessSeconds counts the seconds between from and to (both in the
+// account location) that fall inside business hours, using the same rules
+// as business_hours.DuringBusinessHour: holidays never count, no working
+// days means every moment counts, a working day includes its end minute.
+// Counting stops as soon as the total exceeds limit
+func businessSeconds(bh *apb.BusinessHours, from, to time.Time, limit int64) int64 {
+	var total int64
+	for day := startOfDay(from); day.Before(to) && total <= limit; day = day.AddDate(0, 0, 1) {
+		if isHoliday(bh, day) {
+			continue
+		}
+
+		if len(bh.GetWorkingDays()) == 0 {
+			total += overlapSeconds(from, to, day, day.AddDate(0, 0, 1))
+			continue
+		}
+
+		for _, wd := range bh.GetWorkingDays() {
+			if wd.GetWeekday() != day.Weekday().String() && wd.GetWeekday() != "Everyday" {
+				continue
+			}
+			start, ok1 := parseClock(wd.GetStartTime())
+			end, ok2 := parseClock(wd.GetEndTime())
+			if !ok1 || !ok2 {
+				continue
+			}
+			wstart := time.Date(day.Year(), day.Month(), day.Day(), start/60, start%60, 0, 0, day.Location())
+			wend := time.Date(day.Year(), day.Month(), day.Day(), end/60, end%60+1, 0, 0, day.Location())
+			total += overlapSeconds(from, to, wstart, wend)
+		}
+	}
+	return total
+}
+
+func isHoliday(bh *apb.BusinessHours, day time.Time) bool {
+	for _, h := range bh.GetHolidays() {
+		if int32(day.Year()) == h.GetYear() && int32(day.Month()) == h.GetMonth() &&
+			int32(day.Day()) == h.GetDay() {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapSeconds returns the length of [a1, a2) intersecting [b1, b2)
+func overlapSeconds(a1, a2, b1, b2 time.Time) int64 {
+	start, end := a1, a2
+	if b1.After(start) {
+		start = b1
+	}
+	if b2.Before(end) {
+		end = b2
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return int64(end.Sub(start) / time.Second)
+}
+
+// datetimeTextLayouts are the layouts accepted for dates stored as text,
+// layouts without timezone are read in the account location
+var datetimeTextLayouts = []string{
+	time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02", "02/01/2006",
+}
+
+// parseDatetimeText parses a date stored as text, either in one of
+// datetimeTextLayouts or as unix milliseconds, to unix milliseconds
+func parseDatetimeText(str string, loc *time.Location) (int64, bool) {
+	str = strings.TrimSpace(str)
+	if ms, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return ms, true
+	}
+
+	for _, layout := range datetimeTextLayouts {
+		if t, err := time.ParseInLocation(layout, str, loc); err == nil {
+			return t.UnixMilli(), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,523 @@
+package userutil
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/subiz/header"
+	apb "github.com/subiz/header/account"
+	"google.golang.org/protobuf/proto"
+)
+
+type datetimeCase struct {
+	cond *header.DatetimeCondition
+	at   time.Time
+	want bool
+}
+
+func dt(op string) *header.DatetimeCondition { return &header.DatetimeCondition{Op: op} }
+
+// runDatetimeCases evaluates each case as of now in the timezone of acc
+func runDatetimeCases(t *testing.T, ctx *EvalContext, acc *apb.Account, cases []datetimeCase) {
+	t.Helper()
+	for _, c := range cases {
+		got := EvaluateDatetimeAt(ctx, acc, true, c.at.UnixMilli(), c.cond)
+		if got != c.want {
+			t.Errorf("%s at %s, now %s: got %v, want %v", c.cond.GetOp(), c.at.Format(time.RFC3339), ctx.Now.Format(time.RFC3339), got, c.want)
+		}
+	}
+}
+
+func TestRelativeDatetimeOps(t *testing.T) {
+	loc := LoadTimezone("Asia/Ho_Chi_Minh")
+	acc := &apb.Account{Timezone: ps("Asia/Ho_Chi_Minh")}
+	now := time.Date(2023, 3, 15, 10, 0, 0, 0, loc) // a Wednesday
+	ctx := &EvalContext{Now: now}
+	at := func(month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(2023, month, day, hour, min, sec, 0, loc)
+	}
+
+	runDatetimeCases(t, ctx, acc, []datetimeCase{
+		{dt("today"), at(3, 15, 0, 0, 0), true},
+		{dt("today"), at(3, 15, 23, 59, 59), true},
+		{dt("today"), at(3, 14, 23, 59, 59), false},
+		{dt("today"), at(3, 16, 0, 0, 0), false},
+		{dt("yesterday"), at(3, 14, 0, 0, 0), true},
+		{dt("yesterday"), at(3, 13, 23, 59, 59), false},
+		{dt("yesterday"), at(3, 15, 0, 0, 0), false},
+		{dt("this_week"), at(3, 13, 0, 0, 0), true},
+		{dt("this_week"), at(3, 19, 23, 59, 59), true},
+		{dt("this_week"), at(3, 12, 23, 59, 59), false},
+		{dt("this_week"), at(3, 20, 0, 0, 0), false},
+		{dt("last_week"), at(3, 6, 0, 0, 0), true},
+		{dt("last_week"), at(3, 12, 23, 59, 59), true},
+		{dt("last_week"), at(3, 5, 23, 59, 59), false},
+		{dt("last_week"), at(3, 13, 0, 0, 0), false},
+		{dt("this_month"), at(3, 1, 0, 0, 0), true},
+		{dt("this_month"), at(3, 31, 23, 59, 59), true},
+		{dt("this_month"), at(2, 28, 23, 59, 59), false},
+		{dt("last_month"), at(2, 1, 0, 0, 0), true},
+		{dt("last_month"), at(2, 28, 23, 59, 59), true},
+		{dt("last_month"), at(1, 31, 23, 59, 59), false},
+		{dt("last_month"), at(3, 1, 0, 0, 0), false},
+
+		{dt("date_last_30mins"), now.Add(-30 * time.Minute), true},
+		{dt("date_last_30mins"), now.Add(-30*time.Minute - time.Second), false},
+		{dt("date_last_30mins"), now.Add(time.Second), false},
+		{dt("date_last_2hours"), now.Add(-2 * time.Hour), true},
+		{dt("date_last_2hours"), now.Add(-2*time.Hour - time.Second), false},
+		{dt("date_last_24h"), now.Add(-24 * time.Hour), true},
+		{dt("date_last_24h"), now.Add(-24*time.Hour - time.Second), false},
+		{dt("date_last_7days"), now.Add(-7 * 24 * time.Hour), true},
+		{dt("date_last_7days"), now.Add(-7*24*time.Hour - time.Second), false},
+		{dt("date_last_30days"), now.Add(-30 * 24 * time.Hour), true},
+		{dt("date_last_30days"), now.Add(-30*24*time.Hour - time.Second), false},
+		{dt("date_last_30days"), now.Add(time.Second), false},
+
+		{&header.DatetimeCondition{Op: "last", Last: 3600}, now.Add(-time.Hour), true},
+		{&header.DatetimeCondition{Op: "last", Last: 3600}, now.Add(-time.Hour - time.Second), false},
+		{&header.DatetimeCondition{Op: "last", Last: 3600}, now.Add(time.Second), false},
+		{&header.DatetimeCondition{Op: "before_ago", BeforeAgo: 3600}, now.Add(-time.Hour - time.Second), true},
+		{&header.DatetimeCondition{Op: "before_ago", BeforeAgo: 3600}, now.Add(-time.Hour), false},
+
+		{&header.DatetimeCondition{Op: "after", After: now.UnixMilli()}, now, true},
+		{&header.DatetimeCondition{Op: "after", After: now.UnixMilli()}, now.Add(-time.Second), false},
+		{&header.DatetimeCondition{Op: "before", Before: now.UnixMilli()}, now, true},
+		{&header.DatetimeCondition{Op: "before", Before: now.UnixMilli()}, now.Add(time.Second), false},
+		{&header.DatetimeCondition{Op: "between", Between: []int64{now.UnixMilli(), now.Add(time.Hour).UnixMilli()}}, now.Add(time.Hour), true},
+		{&header.DatetimeCondition{Op: "between", Between: []int64{now.UnixMilli(), now.Add(time.Hour).UnixMilli()}}, now.Add(-time.Second), false},
+		{&header.DatetimeCondition{Op: "outside", Outside: []int64{now.UnixMilli(), now.Add(time.Hour).UnixMilli()}}, now, true},
+		{&header.DatetimeCondition{Op: "outside", Outside: []int64{now.UnixMilli(), now.Add(time.Hour).UnixMilli()}}, now.Add(time.Minute), false},
+	})
+}
+
+func TestRelativeDatetimeOpsFollowTheClock(t *testing.T) {
+	acc := &apb.Account{Timezone: ps("+07:00")}
+	at := time.Date(2023, 3, 15, 10, 0, 0, 0, LoadTimezone("+07:00")).UnixMilli()
+	cond := dt("today")
+
+	if !EvaluateDatetimeAt(&EvalContext{Now: time.UnixMilli(at).Add(time.Hour)}, acc, true, at, cond) {
+		t.Error("want today an hour later")
+	}
+	if EvaluateDatetimeAt(&EvalContext{Now: time.UnixMilli(at).Add(24 * time.Hour)}, acc, true, at, cond) {
+		t.Error("want not today a day later")
+	}
+
+	// every lead of a scan is evaluated as of the same moment
+	defM := map[string]*header.AttributeDefinition{"seen": {Key: "seen", Type: "datetime"}}
+	u := &header.User{Id: "u1", Attributes: []*header.Attribute{{Key: "seen", Datetime: time.UnixMilli(at).Format(time.RFC3339)}}}
+	view := &header.UserViewCondition{Key: "attr:seen", Datetime: cond}
+	users, err := PureFilterUsersAt(&EvalContext{Now: time.UnixMilli(at).Add(24 * time.Hour)}, acc, view, []*header.User{u}, "", 10, "", defM, nil)
+	if err != nil || len(users.GetUsers()) != 0 {
+		t.Errorf("want no user, got %v, %v", users, err)
+	}
+	users, err = PureFilterUsersAt(&EvalContext{Now: time.UnixMilli(at)}, acc, view, []*header.User{u}, "", 10, "", defM, nil)
+	if err != nil || len(users.GetUsers()) != 1 {
+		t.Errorf("want the user, got %v, %v", users, err)
+	}
+}
+
+func TestCalendarOpsAcrossDST(t *testing.T) {
+	loc := LoadTimezone("America/New_York")
+	acc := &apb.Account{Timezone: ps("America/New_York")}
+
+	// clocks go from 02:00 to 03:00 on March 12 2023, the day lasts 23 hours
+	spring := time.Date(2023, 3, 12, 12, 0, 0, 0, loc)
+	runDatetimeCases(t, &EvalContext{Now: spring}, acc, []datetimeCase{
+		{dt("today"), time.Date(2023, 3, 12, 0, 0, 0, 0, loc), true},
+		{dt("today"), time.Date(2023, 3, 12, 3, 0, 0, 0, loc), true},
+		{dt("today"), time.Date(2023, 3, 12, 23, 59, 59, 0, loc), true},
+		{dt("today"), time.Date(2023, 3, 11, 23, 59, 59, 0, loc), false},
+		{dt("today"), time.Date(2023, 3, 13, 0, 0, 0, 0, loc), false},
+		{dt("yesterday"), time.Date(2023, 3, 11, 0, 0, 0, 0, loc), true},
+		{dt("yesterday"), time.Date(2023, 3, 12, 0, 0, 0, 0, loc), false},
+		{dt("date_last_24h"), spring.Add(-24 * time.Hour), true},
+		{dt("date_last_24h"), spring.Add(-24*time.Hour - time.Second), false},
+	})
+
+	// the week after the change starts at midnight EDT
+	runDatetimeCases(t, &EvalContext{Now: time.Date(2023, 3, 14, 12, 0, 0, 0, loc)}, acc, []datetimeCase{
+		{dt("this_week"), time.Date(2023, 3, 13, 0, 0, 0, 0, loc), true},
+		{dt("this_week"), time.Date(2023, 3, 12, 23, 59, 59, 0, loc), false},
+		{dt("last_week"), time.Date(2023, 3, 6, 0, 0, 0, 0, loc), true},
+		{dt("last_week"), time.Date(2023, 3, 12, 23, 59, 59, 0, loc), true},
+		{dt("last_week"), time.Date(2023, 3, 5, 23, 59, 59, 0, loc), false},
+	})
+
+	// clocks go from 02:00 back to 01:00 on November 5 2023, the day lasts 25
+	// hours
+	fall := time.Date(2023, 11, 5, 23, 30, 0, 0, loc)
+	runDatetimeCases(t, &EvalContext{Now: fall}, acc, []datetimeCase{
+		{dt("today"), time.Date(2023, 11, 5, 0, 0, 0, 0, loc), true},
+		{dt("today"), time.Date(2023, 11, 5, 1, 30, 0, 0, loc).Add(time.Hour), true},
+		{dt("today"), time.Date(2023, 11, 4, 23, 59, 59, 0, loc), false},
+		{dt("today"), time.Date(2023, 11, 6, 0, 0, 0, 0, loc), false},
+		{dt("yesterday"), time.Date(2023, 11, 4, 0, 0, 0, 0, loc), true},
+		{dt("this_month"), time.Date(2023, 11, 1, 0, 0, 0, 0, loc), true},
+		{dt("last_month"), time.Date(2023, 10, 31, 23, 59, 59, 0, loc), true},
+		{dt("date_last_24h"), fall.Add(-24 * time.Hour), true},
+		{dt("date_last_24h"), fall.Add(-24*time.Hour - time.Second), false},
+	})
+}
+
+func TestWeekBoundaries(t *testing.T) {
+	loc := LoadTimezone("+07:00")
+
+	// weeks spanning two years
+	acc := &apb.Account{Timezone: ps("+07:00")}
+	runDatetimeCases(t, &EvalContext{Now: time.Date(2024, 1, 1, 8, 0, 0, 0, loc)}, acc, []datetimeCase{
+		{dt("this_week"), time.Date(2024, 1, 1, 0, 0, 0, 0, loc), true},
+		{dt("this_week"), time.Date(2024, 1, 7, 23, 59, 59, 0, loc), true},
+		{dt("this_week"), time.Date(2023, 12, 31, 23, 59, 59, 0, loc), false},
+		{dt("last_week"), time.Date(2023, 12, 25, 0, 0, 0, 0, loc), true},
+		{dt("last_week"), time.Date(2023, 12, 31, 23, 59, 59, 0, loc), true},
+		{dt("last_week"), time.Date(2024, 1, 1, 0, 0, 0, 0, loc), false},
+	})
+
+	// Sunday 2023-03-12 belongs to the week of Monday 2023-03-06 unless
+	// weeks start on Sunday
+	sunday := &EvalContext{Now: time.Date(2023, 3, 12, 8, 0, 0, 0, loc)}
+	runDatetimeCases(t, sunday, acc, []datetimeCase{
+		{dt("this_week"), time.Date(2023, 3, 6, 0, 0, 0, 0, loc), true},
+		{dt("this_week"), time.Date(2023, 3, 11, 23, 59, 59, 0, loc), true},
+		{dt("this_week"), time.Date(2023, 3, 13, 0, 0, 0, 0, loc), false},
+	})
+
+	for _, weekStart := range []string{"sunday", "Sun", "0"} {
+		runDatetimeCases(t, &EvalContext{Now: sunday.Now, WeekStart: weekStart}, acc, []datetimeCase{
+			{dt("this_week"), time.Date(2023, 3, 12, 0, 0, 0, 0, loc), true},
+			{dt("this_week"), time.Date(2023, 3, 18, 23, 59, 59, 0, loc), true},
+			{dt("this_week"), time.Date(2023, 3, 11, 23, 59, 59, 0, loc), false},
+			{dt("last_week"), time.Date(2023, 3, 5, 0, 0, 0, 0, loc), true},
+			{dt("last_week"), time.Date(2023, 3, 11, 23, 59, 59, 0, loc), true},
+		})
+	}
+
+	// unknown week starts fall back to Monday
+	runDatetimeCases(t, &EvalContext{Now: sunday.Now, WeekStart: "someday"}, acc, []datetimeCase{
+		{dt("this_week"), time.Date(2023, 3, 6, 0, 0, 0, 0, loc), true},
+		{dt("this_week"), time.Date(2023, 3, 13, 0, 0, 0, 0, loc), false},
+	})
+
+	// the whole scan reads the context
+	defM := map[string]*header.AttributeDefinition{"seen": {Key: "seen", Type: "datetime"}}
+	u := &header.User{Id: "u1", Attributes: []*header.Attribute{
+		{Key: "seen", Datetime: time.Date(2023, 3, 11, 12, 0, 0, 0, loc).Format(time.RFC3339)},
+	}}
+	cond := &header.UserViewCondition{Key: "attr:seen", Datetime: dt("this_week")}
+	if ok, _ := RsCheckAt(sunday, acc, defM, u, cond, false); !ok {
+		t.Error("want this week with weeks starting on Monday")
+	}
+	if ok, _ := RsCheckAt(&EvalContext{Now: sunday.Now, WeekStart: "sunday"}, acc, defM, u, cond, false); ok {
+		t.Error("want last week with weeks starting on Sunday")
+	}
+}
+
+func TestQuarterAndYearOps(t *testing.T) {
+	loc := LoadTimezone("Asia/Ho_Chi_Minh")
+	acc := &apb.Account{Timezone: ps("Asia/Ho_Chi_Minh")}
+	day := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	}
+	end := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 23, 59, 59, 0, loc)
+	}
+
+	// a leap day
+	ctx := &EvalContext{Now: time.Date(2024, 2, 29, 12, 0, 0, 0, loc)}
+	runDatetimeCases(t, ctx, acc, []datetimeCase{
+		{dt("this_month"), end(2024, 2, 29), true},
+		{dt("this_month"), day(2024, 3, 1), false},
+		{dt("this_quarter"), day(2024, 1, 1), true},
+		{dt("this_quarter"), end(2024, 3, 31), true},
+		{dt("this_quarter"), end(2023, 12, 31), false},
+		{dt("this_quarter"), day(2024, 4, 1), false},
+		{dt("last_quarter"), day(2023, 10, 1), true},
+		{dt("last_quarter"), end(2023, 12, 31), true},
+		{dt("last_quarter"), end(2023, 9, 30), false},
+		{dt("this_year"), day(2024, 1, 1), true},
+		{dt("this_year"), end(2024, 12, 31), true},
+		{dt("this_year"), end(2023, 12, 31), false},
+		{dt("last_year"), day(2023, 1, 1), true},
+		{dt("last_year"), end(2023, 12, 31), true},
+		{dt("last_year"), end(2022, 12, 31), false},
+		{dt("this_fiscal_year"), day(2024, 1, 1), true},
+		{dt("last_fiscal_quarter"), day(2023, 10, 1), true},
+	})
+
+	// months of different lengths
+	runDatetimeCases(t, &EvalContext{Now: time.Date(2024, 3, 31, 12, 0, 0, 0, loc)}, acc, []datetimeCase{
+		{dt("last_month"), day(2024, 2, 1), true},
+		{dt("last_month"), end(2024, 2, 29), true},
+		{dt("last_month"), end(2024, 1, 31), false},
+		{dt("this_month"), end(2024, 3, 31), true},
+	})
+	runDatetimeCases(t, &EvalContext{Now: time.Date(2023, 3, 1, 0, 0, 0, 0, loc)}, acc, []datetimeCase{
+		{dt("last_month"), end(2023, 2, 28), true},
+		{dt("last_month"), day(2023, 2, 1), true},
+		{dt("yesterday"), day(2023, 2, 28), true},
+		{dt("this_quarter"), day(2023, 1, 1), true},
+	})
+
+	// fiscal years starting in April
+	fiscal := &EvalContext{Now: ctx.Now, FiscalYearStartMonth: time.April}
+	runDatetimeCases(t, fiscal, acc, []datetimeCase{
+		{dt("this_fiscal_year"), day(2023, 4, 1), true},
+		{dt("this_fiscal_year"), end(2024, 3, 31), true},
+		{dt("this_fiscal_year"), end(2023, 3, 31), false},
+		{dt("this_fiscal_year"), day(2024, 4, 1), false},
+		{dt("last_fiscal_year"), day(2022, 4, 1), true},
+		{dt("last_fiscal_year"), end(2023, 3, 31), true},
+		{dt("last_fiscal_year"), day(2023, 4, 1), false},
+		{dt("this_fiscal_quarter"), day(2024, 1, 1), true},
+		{dt("this_fiscal_quarter"), end(2024, 3, 31), true},
+		{dt("this_fiscal_quarter"), end(2023, 12, 31), false},
+		{dt("last_fiscal_quarter"), day(2023, 10, 1), true},
+		{dt("last_fiscal_quarter"), end(2023, 12, 31), true},
+		{dt("last_fiscal_quarter"), end(2023, 9, 30), false},
+		// calendar quarters and years ignore the fiscal year
+		{dt("this_year"), day(2024, 1, 1), true},
+		{dt("this_quarter"), day(2024, 1, 1), true},
+	})
+
+	// fiscal years starting in July
+	july := &EvalContext{Now: ctx.Now, FiscalYearStartMonth: time.July}
+	runDatetimeCases(t, july, acc, []datetimeCase{
+		{dt("this_fiscal_year"), day(2023, 7, 1), true},
+		{dt("this_fiscal_year"), end(2023, 6, 30), false},
+		{dt("this_fiscal_quarter"), day(2024, 1, 1), true},
+		{dt("last_fiscal_quarter"), day(2023, 10, 1), true},
+	})
+
+	// the whole scan reads the context
+	defM := map[string]*header.AttributeDefinition{"paid": {Key: "paid", Type: "datetime"}}
+	u := &header.User{Id: "u1", Attributes: []*header.Attribute{{Key: "paid", Datetime: day(2023, 5, 1).Format(time.RFC3339)}}}
+	cond := &header.UserViewCondition{Key: "attr:paid", Datetime: dt("this_fiscal_year")}
+	if ok, _ := RsCheckAt(fiscal, acc, defM, u, cond, false); !ok {
+		t.Error("want this fiscal year with fiscal years starting in April")
+	}
+	if ok, _ := RsCheckAt(ctx, acc, defM, u, cond, false); ok {
+		t.Error("want last fiscal year with fiscal years starting in January")
+	}
+}
+
+func TestAnniversaryAndCalendarFieldOps(t *testing.T) {
+	loc := LoadTimezone("Asia/Ho_Chi_Minh")
+	acc := &apb.Account{Timezone: ps("Asia/Ho_Chi_Minh")}
+	birth := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 9, 30, 0, 0, loc)
+	}
+	now := func(year int, month time.Month, day int) *EvalContext {
+		return &EvalContext{Now: time.Date(year, month, day, 15, 0, 0, 0, loc)}
+	}
+
+	runDatetimeCases(t, now(2023, 6, 10), acc, []datetimeCase{
+		{dt("anniversary_today"), birth(1990, 6, 10), true},
+		{dt("anniversary_today"), birth(1990, 6, 11), false},
+		{dt("anniversary_in_next:0"), birth(1990, 6, 10), true},
+		{dt("anniversary_in_next:7"), birth(1990, 6, 17), true},
+		{dt("anniversary_in_next:7"), birth(1990, 6, 18), false},
+		// passed this year, next one is in 2024
+		{dt("anniversary_in_next:7"), birth(1990, 6, 9), false},
+		{dt("anniversary_in_next:365"), birth(1990, 6, 9), true},
+		{dt("month_is:6"), birth(1990, 6, 30), true},
+		{dt("month_is:jan,June"), birth(1990, 6, 30), true},
+		{dt("month_is:7"), birth(1990, 6, 30), false},
+		{dt("day_of_month_is:10,31"), birth(1990, 1, 31), true},
+		{dt("day_of_month_is:10,30"), birth(1990, 1, 31), false},
+	})
+
+	// anniversaries crossing the year end
+	runDatetimeCases(t, now(2023, 12, 28), acc, []datetimeCase{
+		{dt("anniversary_in_next:5"), birth(2000, 1, 2), true},
+		{dt("anniversary_in_next:4"), birth(2000, 1, 2), false},
+		{dt("anniversary_in_next:3"), birth(2000, 12, 31), true},
+	})
+
+	// February 29 anniversaries fall on February 28 in non-leap years
+	leapling := birth(2000, 2, 29)
+	runDatetimeCases(t, now(2023, 2, 28), acc, []datetimeCase{
+		{dt("anniversary_today"), leapling, true},
+		{dt("anniversary_today"), birth(2001, 2, 28), true},
+		{dt("anniversary_in_next:0"), leapling, true},
+	})
+	runDatetimeCases(t, now(2023, 3, 1), acc, []datetimeCase{
+		{dt("anniversary_today"), leapling, false},
+		// 2024 is a leap year
+		{dt("anniversary_in_next:365"), leapling, true},
+		{dt("anniversary_in_next:364"), leapling, false},
+	})
+	runDatetimeCases(t, now(2024, 2, 28), acc, []datetimeCase{
+		{dt("anniversary_today"), leapling, false},
+		{dt("anniversary_in_next:1"), leapling, true},
+		{dt("anniversary_in_next:0"), leapling, false},
+	})
+	runDatetimeCases(t, now(2024, 2, 29), acc, []datetimeCase{
+		{dt("anniversary_today"), leapling, true},
+		{dt("anniversary_today"), birth(2001, 2, 28), false},
+		{dt("day_of_month_is:29"), leapling, true},
+		{dt("month_is:feb"), leapling, true},
+	})
+
+	// the day is read in the account timezone: 23:30 UTC is already the next
+	// day in Ho Chi Minh City
+	utc := time.Date(1990, 6, 9, 23, 30, 0, 0, time.UTC)
+	runDatetimeCases(t, now(2023, 6, 10), acc, []datetimeCase{
+		{dt("anniversary_today"), utc, true},
+		{dt("day_of_month_is:10"), utc, true},
+	})
+}
+
+func TestDatetimeOpsOnMissingValues(t *testing.T) {
+	acc := &apb.Account{Timezone: ps("UTC")}
+	// the zero value is January 1 1970, any op reading it must not match
+	ctx := &EvalContext{Now: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)}
+	for _, op := range []string{
+		"anniversary_today", "anniversary_in_next:30", "month_is:1", "day_of_month_is:1",
+	} {
+		if EvaluateDatetimeAt(ctx, acc, false, 0, dt(op)) {
+			t.Errorf("%s must not match a missing value", op)
+		}
+	}
+
+	// unparseable datetime attributes are missing
+	defM := map[string]*header.AttributeDefinition{"birthday": {Key: "birthday", Type: "datetime"}}
+	u := &header.User{Id: "u1", Attributes: []*header.Attribute{{Key: "birthday", Datetime: "not a date"}}}
+	if _, _, _, _, found := FindAttr(u, "birthday", "datetime"); found {
+		t.Error("want an unparseable datetime not found")
+	}
+	for _, op := range []string{"anniversary_today", "month_is:1", "has_value"} {
+		cond := &header.UserViewCondition{Key: "attr:birthday", Datetime: dt(op)}
+		if ok, _ := RsCheckAt(ctx, acc, defM, u, cond, false); ok {
+			t.Errorf("%s must not match an unparseable datetime", op)
+		}
+	}
+	cond := &header.UserViewCondition{Key: "attr:birthday", Datetime: dt("unset")}
+	if ok, _ := RsCheckAt(ctx, acc, defM, u, cond, false); !ok {
+		t.Error("want an unparseable datetime unset")
+	}
+}
+
+func TestForwardLookingDatetimeOps(t *testing.T) {
+	loc := LoadTimezone("America/New_York")
+	acc := &apb.Account{Timezone: ps("America/New_York")}
+	at := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, loc)
+	}
+
+	// the day before clocks go forward, tomorrow lasts 23 hours
+	ctx := &EvalContext{Now: at(2023, 3, 11, 12, 0, 0)}
+	runDatetimeCases(t, ctx, acc, []datetimeCase{
+		{dt("tomorrow"), at(2023, 3, 12, 0, 0, 0), true},
+		{dt("tomorrow"), at(2023, 3, 12, 23, 59, 59), true},
+		{dt("tomorrow"), at(2023, 3, 11, 23, 59, 59), false},
+		{dt("tomorrow"), at(2023, 3, 13, 0, 0, 0), false},
+		{dt("next_week"), at(2023, 3, 13, 0, 0, 0), true},
+		{dt("next_week"), at(2023, 3, 19, 23, 59, 59), true},
+		{dt("next_week"), at(2023, 3, 12, 23, 59, 59), false},
+		{dt("next_week"), at(2023, 3, 20, 0, 0, 0), false},
+		{dt("next_month"), at(2023, 4, 1, 0, 0, 0), true},
+		{dt("next_month"), at(2023, 4, 30, 23, 59, 59), true},
+		{dt("next_month"), at(2023, 3, 31, 23, 59, 59), false},
+		{dt("next_month"), at(2023, 5, 1, 0, 0, 0), false},
+		// next and after_from_now count seconds, not wall clock hours
+		{dt("next:86400"), ctx.Now.Add(24 * time.Hour), true},
+		{dt("next:86400"), ctx.Now.Add(24*time.Hour + time.Second), false},
+		{dt("next:86400"), ctx.Now.Add(-time.Second), false},
+		{dt("after_from_now:86400"), ctx.Now.Add(24*time.Hour + time.Second), true},
+		{dt("after_from_now:86400"), ctx.Now.Add(24 * time.Hour), false},
+		{dt("after_from_now:86400"), at(2023, 3, 12, 12, 0, 0), false},
+	})
+
+	// month ends and leap years
+	runDatetimeCases(t, &EvalContext{Now: at(2024, 1, 31, 12, 0, 0)}, acc, []datetimeCase{
+		{dt("next_month"), at(2024, 2, 1, 0, 0, 0), true},
+		{dt("next_month"), at(2024, 2, 29, 23, 59, 59), true},
+		{dt("next_month"), at(2024, 3, 1, 0, 0, 0), false},
+		{dt("tomorrow"), at(2024, 2, 1, 8, 0, 0), true},
+	})
+	runDatetimeCases(t, &EvalContext{Now: at(2024, 2, 28, 12, 0, 0)}, acc, []datetimeCase{
+		{dt("tomorrow"), at(2024, 2, 29, 8, 0, 0), true},
+		{dt("tomorrow"), at(2024, 3, 1, 8, 0, 0), false},
+	})
+	runDatetimeCases(t, &EvalContext{Now: at(2023, 12, 31, 12, 0, 0)}, acc, []datetimeCase{
+		{dt("tomorrow"), at(2024, 1, 1, 0, 0, 0), true},
+		{dt("next_month"), at(2024, 1, 31, 23, 59, 59), true},
+		// Sunday, next week starts on Monday January 1
+		{dt("next_week"), at(2024, 1, 1, 0, 0, 0), true},
+		{dt("next_week"), at(2023, 12, 31, 23, 59, 59), false},
+	})
+
+	// weeks starting on Sunday
+	sunday := &EvalContext{Now: at(2023, 3, 11, 12, 0, 0), WeekStart: "sunday"}
+	runDatetimeCases(t, sunday, acc, []datetimeCase{
+		{dt("next_week"), at(2023, 3, 12, 0, 0, 0), true},
+		{dt("next_week"), at(2023, 3, 18, 23, 59, 59), true},
+		{dt("next_week"), at(2023, 3, 19, 0, 0, 0), false},
+	})
+}
+
+func TestTimeOfDayAndBusinessHoursOps(t *testing.T) {
+	loc := LoadTimezone("America/New_York")
+	acc := &apb.Account{Timezone: ps("America/New_York"), BusinessHours: &apb.BusinessHours{
+		WorkingDays: []*apb.BusinessHours_WorkingDay{
+			{Weekday: proto.String("Monday"), StartTime: proto.String("09:00"), EndTime: proto.String("17:00")},
+			{Weekday: proto.String("Tuesday"), StartTime: proto.String("09:00"), EndTime: proto.String("17:00")},
+			{Weekday: proto.String("Wednesday"), StartTime: proto.String("09:00"), EndTime: proto.String("17:00")},
+			{Weekday: proto.String("Thursday"), StartTime: proto.String("09:00"), EndTime: proto.String("17:00")},
+			{Weekday: proto.String("Friday"), StartTime: proto.String("09:00"), EndTime: proto.String("17:00")},
+		},
+	}}
+	at := func(month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(2023, month, day, hour, min, sec, 0, loc)
+	}
+
+	// Monday after clocks went forward on Sunday March 12
+	ctx := &EvalContext{Now: at(3, 13, 10, 0, 0)}
+	friday := at(3, 10, 16, 30, 0)
+	// 31 minutes on Friday, the end minute included, and an hour on Monday
+	const worked = 31*60 + 3600
+	runDatetimeCases(t, ctx, acc, []datetimeCase{
+		{dt("time_of_day:09:00,17:00"), at(3, 13, 9, 0, 0), true},
+		{dt("time_of_day:09:00,17:00"), at(3, 13, 17, 0, 59), true},
+		{dt("time_of_day:09:00,17:00"), at(3, 13, 17, 1, 0), false},
+		{dt("time_of_day:09:00,17:00"), at(3, 13, 8, 59, 59), false},
+		{dt("time_of_day:22:00,06:00"), at(3, 13, 23, 0, 0), true},
+		{dt("time_of_day:22:00,06:00"), at(3, 13, 5, 59, 0), true},
+		{dt("time_of_day:22:00,06:00"), at(3, 13, 12, 0, 0), false},
+		// 02:30 does not exist on March 12, the wall clock reads 03:30
+		{dt("time_of_day:03:00,03:59"), at(3, 12, 3, 30, 0), true},
+		{dt("time_of_day:02:00,02:59"), at(3, 12, 1, 59, 0).Add(31 * time.Minute), false},
+
+		{dt("in_business_hour"), at(3, 13, 9, 0, 0), true},
+		{dt("in_business_hour"), at(3, 12, 12, 0, 0), false},
+		{dt("non_business_hour"), at(3, 12, 12, 0, 0), true},
+
+		{dt("business_hours_last:" + strconv.Itoa(worked)), friday, true},
+		{dt("business_hours_last:" + strconv.Itoa(worked-1)), friday, false},
+		{dt("business_hours_before_ago:" + strconv.Itoa(worked-1)), friday, true},
+		{dt("business_hours_before_ago:" + strconv.Itoa(worked)), friday, false},
+		// the weekend does not count
+		{dt("business_hours_last:3600"), at(3, 11, 12, 0, 0), true},
+		{dt("business_hours_last:3599"), at(3, 11, 12, 0, 0), false},
+		// dates in the future are neither
+		{dt("business_hours_last:3600"), ctx.Now.Add(time.Second), false},
+		{dt("business_hours_before_ago:0"), ctx.Now.Add(time.Second), false},
+	})
+
+	// holidays never count
+	holiday := proto.Clone(acc).(*apb.Account)
+	holiday.BusinessHours.Holidays = []*apb.BusinessHours_Holiday{{Year: proto.Int32(2023), Month: proto.Int32(3), Day: proto.Int32(13)}}
+	runDatetimeCases(t, ctx, holiday, []datetimeCase{
+		{dt("business_hours_last:" + strconv.Itoa(31*60)), friday, true},
+		{dt("business_hours_before_ago:" + strconv.Itoa(31*60-1)), friday, true},
+		{dt("in_business_hour"), at(3, 13, 9, 30, 0), false},
+	})
+
+	for _, op := range []string{"time_of_day:00:00,23:59", "business_hours_last:999999999", "business_hours_before_ago:0"} {
+		if EvaluateDatetimeAt(ctx, acc, false, 0, dt(op)) {
+			t.Errorf("%s must not match a missing value", op)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package userutil
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/subiz/header"
+	apb "github.com/subiz/header/account"
+)
+
+// EvalTrace is the evaluation tree of a condition against a single user.
+// Kind is one of "all", "one", "not" or "leaf". For leaves, Values are the user
+// values after transforms, lower-casing and ascii folding, compared against
+// Operands. ShortCircuit marks the child which decided its group's result
+type EvalTrace struct {
+	Kind         string       `json:"kind,omitempty"`
+	Key          string       `json:"key,omitempty"`
+	Op           string       `json:"op,omitempty"`
+	Values       []string     `json:"values,omitempty"`
+	Operands     []string     `json:"operands,omitempty"`
+	Result       bool         `json:"result"`
+	ShortCircuit bool         `json:"short_circuit,omitempty"`
+	Error        string       `json:"error,omitempty"`
+	Children     []*EvalTrace `json:"children,omitempty"`
+}
+
+// Explain evaluates cond against user u like RsCheck and returns why it did
+// or did not match. Every child is evaluated, even after the group result is
+// known, so the trace shows the whole tree
+func Explain(acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User, cond *header.UserViewCondition) *EvalTrace {
+	return ExplainAt(&EvalContext{Now: time.Now()}, acc, defM, u, cond)
+}
+
+// ExplainAt is Explain evaluated as of ctx.Now
+func ExplainAt(ctx *EvalContext, acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User, cond *header.UserViewCondition) *EvalTrace {
+	c, err := Compile(acc, defM, cond)
+	if err != nil {
+		return &EvalTrace{Error: err.Error()}
+	}
+
+	trace := c.root.explain(ctx, u)
+	if c.deleted && u.Deleted == 0 {
+		trace.Result = false
+		trace.Error = "user is not deleted"
+	}
+
+	if !c.deleted && u.Deleted > 0 {
+		trace.Result = false
+		trace.Error = "user is deleted"
+	}
+	return trace
+}
+
+func (n *compiledNode) explain(ctx *EvalContext, u *header.User) *EvalTrace {
+	if n.not != nil {
+		child := n.not.explain(ctx, u)
+		return &EvalTrace{Kind: "not", Result: !child.Result, Children: []*EvalTrace{child}}
+	}
+
+	if len(n.one) > 0 {
+		trace := &EvalTrace{Kind: "one"}
+		for _, c := range n.one {
+			child := c.explain(ctx, u)
+			if child.Result && !trace.Result {
+				child.ShortCircuit = true
+				trace.Result = true
+			}
+			trace.Children = append(trace.Children, child)
+		}
+		return trace
+	}
+
+	if len(n.all) > 0 {
+		trace := &EvalTrace{Kind: "all", Result: true}
+		for _, c := range n.all {
+			child := c.explain(ctx, u)
+			if !child.Result && trace.Result {
+				child.ShortCircuit = true
+				trace.Result = false
+			}
+			trace.Children = append(trace.Children, child)
+		}
+		return trace
+	}
+
+	trace := &EvalTrace{
+		Kind:     "leaf",
+		Key:      n.leaf.key,
+		Op:       n.leaf.op,
+		Operands: n.leaf.operands,
+		Result:   n.leaf.match(ctx, u),
+	}
+	if n.leaf.values != nil {
+		trace.Values = n.leaf.values(ctx, u)
+	}
+	return trace
+}
+
+func (m *textMatcher) explainOperands() []string {
+	if m.op == "regex" {
+		return []string{m.re.String()}
+	}
+	return m.operands
+}
+
+func floatOperands(cond *header.FloatCondition) []string {
+	var operands []float64
+	switch cond.GetOp() {
+	case "eq":
+		operands = cond.GetEq()
+	case "neq":
+		operands = cond.GetNeq()
+	case "gt":
+		operands = []float64{cond.GetGt()}
+	case "lt":
+		operands = []float64{cond.GetLt()}
+	case "gte":
+		operands = []float64{cond.GetGte()}
+	case "lte":
+		operands = []float64{cond.GetLte()}
+	case "in_range":
+		operands = cond.GetInRange()
+	case "not_in_range":
+		operands = cond.GetNotInRange()
+	}
+
+	out := []string{}
+	for _, f := range operands {
+		out = append(out, strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return out
+}
+
+func datetimeOperands(cond *header.DatetimeCondition) []string {
+	var operands []int64
+	op, args := splitOp(cond.GetOp())
+	switch op {
+	case "days_of_week":
+		return cond.GetDaysOfWeek()
+	case "last":
+		operands = []int64{cond.GetLast()}
+	case "before_ago":
+		operands = []int64{cond.GetBeforeAgo()}
+	case "after":
+		operands = []int64{cond.GetAfter()}
+	case "before":
+		operands = []int64{cond.GetBefore()}
+	case "between":
+		operands = cond.GetBetween()
+	case "outside":
+		operands = cond.GetOutside()
+	default:
+		return args
+	}
+
+	out := []string{}
+	for _, i := range operands {
+		out = append(out, strconv.FormatInt(i, 10))
+	}
+	return out
+}
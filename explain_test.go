@@ -0,0 +1,112 @@
+package userutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subiz/header"
+)
+
+func TestExplain(t *testing.T) {
+	ctx := &EvalContext{Now: time.Date(2023, 7, 12, 10, 0, 0, 0, time.UTC)}
+	defM := map[string]*header.AttributeDefinition{
+		"name":  {Key: "name", Type: "text"},
+		"score": {Key: "score", Type: "number"},
+	}
+	u := &header.User{
+		Id:         "U1",
+		Labels:     []*header.Label{{Label: "VIP"}, {Label: "Trial"}},
+		Attributes: []*header.Attribute{{Key: "name", Text: "Thành Nguyễn"}, {Key: "score", Number: 7}},
+	}
+	yes := &header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "contain", Contain: []string{"Thanh"}}}
+	no := &header.UserViewCondition{Key: "attr:score", Number: &header.FloatCondition{Op: "gt", Gt: 10}}
+
+	// every child is evaluated, the first deciding one is marked
+	trace := ExplainAt(ctx, nil, defM, u, &header.UserViewCondition{All: []*header.UserViewCondition{yes, no, no}})
+	if trace.Kind != "all" || trace.Result || len(trace.Children) != 3 {
+		t.Fatalf("want a failed all of 3 children, got %+v", trace)
+	}
+	for i, want := range []struct{ result, short bool }{{true, false}, {false, true}, {false, false}} {
+		if c := trace.Children[i]; c.Kind != "leaf" || c.Result != want.result || c.ShortCircuit != want.short {
+			t.Errorf("all child %d: got result %v, short circuit %v", i, c.Result, c.ShortCircuit)
+		}
+	}
+	leaf := trace.Children[0]
+	if leaf.Key != "attr:name" || leaf.Op != "contain" || !reflect.DeepEqual(leaf.Values, []string{"thanh nguyen"}) || !reflect.DeepEqual(leaf.Operands, []string{"thanh"}) {
+		t.Errorf("want the folded values and operands, got %+v", leaf)
+	}
+	if c := trace.Children[1]; !reflect.DeepEqual(c.Values, []string{"7"}) || !reflect.DeepEqual(c.Operands, []string{"10"}) {
+		t.Errorf("want the number values and operands, got %+v", c)
+	}
+
+	trace = ExplainAt(ctx, nil, defM, u, &header.UserViewCondition{One: []*header.UserViewCondition{no, yes, yes}})
+	if trace.Kind != "one" || !trace.Result || len(trace.Children) != 3 {
+		t.Fatalf("want a matched one of 3 children, got %+v", trace)
+	}
+	for i, want := range []struct{ result, short bool }{{false, false}, {true, true}, {true, false}} {
+		if c := trace.Children[i]; c.Result != want.result || c.ShortCircuit != want.short {
+			t.Errorf("one child %d: got result %v, short circuit %v", i, c.Result, c.ShortCircuit)
+		}
+	}
+
+	// negations hold the trace of the group they negate
+	trace = ExplainAt(ctx, nil, defM, u, &header.UserViewCondition{Key: NotKey, All: []*header.UserViewCondition{yes}})
+	if trace.Kind != "not" || trace.Result || len(trace.Children) != 1 {
+		t.Fatalf("want a failed not, got %+v", trace)
+	}
+	if c := trace.Children[0]; c.Kind != "all" || !c.Result || len(c.Children) != 1 || !c.Children[0].Result {
+		t.Errorf("want the matched group, got %+v", c)
+	}
+}
+
+func TestExplainValues(t *testing.T) {
+	u := &header.User{
+		Id:         "U1",
+		Labels:     []*header.Label{{Label: "VIP"}, {Label: "Trial"}},
+		Attributes: []*header.Attribute{{Key: "fullname", Text: "Thành Nguyễn"}, {Key: "phone", Text: "0912 345 678"}},
+	}
+
+	trace := Explain(nil, nil, u, &header.UserViewCondition{Key: "labels", Text: &header.TextCondition{Op: "any/eq", Eq: []string{"Vip"}}})
+	if !trace.Result || !reflect.DeepEqual(trace.Values, []string{"vip", "trial"}) || !reflect.DeepEqual(trace.Operands, []string{"vip"}) {
+		t.Errorf("want the folded labels, got %+v", trace)
+	}
+
+	trace = Explain(nil, nil, u, &header.UserViewCondition{Key: "keyword", Text: &header.TextCondition{Op: "contain", Contain: []string{"Thành Ng"}}})
+	if !trace.Result || !reflect.DeepEqual(trace.Values, []string{"thanhnguyen", "0912345678", "u1"}) || !reflect.DeepEqual(trace.Operands, []string{"thanhng"}) {
+		t.Errorf("want the searched values, got %+v", trace)
+	}
+
+	// dates stored as text are read in the location the match uses
+	defM := map[string]*header.AttributeDefinition{"signup": {Key: "signup", Type: "text"}}
+	u = &header.User{Id: "u2", Attributes: []*header.Attribute{{Key: "signup", Text: "2023-07-12 09:00:00"}}}
+	ctx := &EvalContext{Now: time.Date(2023, 7, 12, 12, 0, 0, 0, time.UTC), Location: LoadTimezone("+07:00")}
+	cond := &header.UserViewCondition{Key: "attr:signup", Datetime: &header.DatetimeCondition{Op: "today"}}
+	trace = ExplainAt(ctx, nil, defM, u, cond)
+	if !trace.Result || !reflect.DeepEqual(trace.Values, []string{"2023-07-12T02:00:00Z"}) {
+		t.Errorf("want the date read at +07:00, got %+v", trace)
+	}
+}
+
+func TestExplainErrors(t *testing.T) {
+	u := &header.User{Id: "u1", Attributes: []*header.Attribute{{Key: "name", Text: "Lan"}}}
+	defM := map[string]*header.AttributeDefinition{"name": {Key: "name", Type: "text"}}
+
+	trace := Explain(nil, defM, u, &header.UserViewCondition{All: []*header.UserViewCondition{
+		{Key: "attr:name", Text: &header.TextCondition{Op: "regex", Regex: "(lan"}},
+	}})
+	if trace.Result || !strings.Contains(trace.Error, "invalid regex") || len(trace.Children) > 0 {
+		t.Errorf("want the compile error, got %+v", trace)
+	}
+
+	cond := &header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan"}}}
+	deleted := &header.User{Id: "u2", Deleted: 1, Attributes: u.Attributes}
+	if trace := Explain(nil, defM, deleted, cond); trace.Result || trace.Error != "user is deleted" {
+		t.Errorf("want a deleted user error, got %+v", trace)
+	}
+	cond.Deleted = true
+	if trace := Explain(nil, defM, u, cond); trace.Result || trace.Error != "user is not deleted" {
+		t.Errorf("want a not deleted user error, got %+v", trace)
+	}
+}
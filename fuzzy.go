@@ -0,0 +1,188 @@
+package userutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/thanhpk/ascii"
+)
+
+// fuzzyMatcher implements the approximate text ops, operands come from
+// TextCondition.Eq:
+//   - edit_distance:N  the value is at most N edits away from an operand
+//   - similarity:0.8   the token sets of the value and an operand overlap at
+//     least 80% (jaccard index)
+//   - sounds_like      the value is pronounced like an operand, spelling
+//     variants of vietnamese names (d/gi/r, ch/tr, s/x, n/ng...) are ignored
+type fuzzyMatcher struct {
+	op            string
+	maxDistance   int
+	minSimilarity float64
+	operands      [][]rune
+	tokens        []map[string]bool
+	phonetics     []string
+}
+
+func newFuzzyMatcher(op string, args []string, operands []string) (*fuzzyMatcher, error) {
+	m := &fuzzyMatcher{op: op}
+	switch op {
+	case "edit_distance":
+		n, ok := intArg(args)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("edit_distance requires a number of edits")
+		}
+		m.maxDistance = int(n)
+		for _, operand := range operands {
+			m.operands = append(m.operands, []rune(operand))
+		}
+	case "similarity":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("similarity requires a threshold")
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(args[0]), 64)
+		if err != nil || f <= 0 || f > 1 {
+			return nil, fmt.Errorf("invalid similarity threshold %q", args[0])
+		}
+		m.minSimilarity = f
+		for _, operand := range operands {
+			m.tokens = append(m.tokens, tokenSet(operand))
+		}
+	case "sounds_like":
+		for _, operand := range operands {
+			m.phonetics = append(m.phonetics, phoneticKey(operand))
+		}
+	}
+	return m, nil
+}
+
+func (m *fuzzyMatcher) match(str string) bool {
+	switch m.op {
+	case "edit_distance":
+		runes := []rune(str)
+		for _, operand := range m.operands {
+			if editDistance(runes, operand) <= m.maxDistance {
+				return true
+			}
+		}
+	case "similarity":
+		tokens := tokenSet(str)
+		for _, operand := range m.tokens {
+			if jaccard(tokens, operand) >= m.minSimilarity {
+				return true
+			}
+		}
+	case "sounds_like":
+		key := phoneticKey(str)
+		if key == "" {
+			return false
+		}
+		for _, operand := range m.phonetics {
+			if key == operand {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// editDistance returns the levenshtein distance between a and b
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func tokenize(str string) []string {
+	return strings.FieldsFunc(str, func(ch rune) bool {
+		return !unicode.IsLetter(ch) && !unicode.IsDigit(ch)
+	})
+}
+
+func tokenSet(str string) map[string]bool {
+	set := map[string]bool{}
+	for _, token := range tokenize(str) {
+		set[token] = true
+	}
+	return set
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	inter := 0
+	for token := range a {
+		if b[token] {
+			inter++
+		}
+	}
+	return float64(inter) / float64(len(a)+len(b)-inter)
+}
+
+// phonetic rules are tried in order, the first matching rule wins
+var phoneticInitials = [][2]string{
+	{"ngh", "ng"}, {"gh", "g"}, {"gi", "z"}, {"tr", "c"}, {"ch", "c"}, {"ph", "f"},
+	{"d", "z"}, {"r", "z"}, {"k", "c"}, {"q", "c"}, {"s", "x"},
+}
+
+var phoneticFinals = [][2]string{
+	{"nh", "n"}, {"ng", "n"}, {"ch", "t"}, {"c", "t"},
+}
+
+// phoneticKey folds a vietnamese text to its pronunciation, e.g: "Trần Dũng"
+// and "Chan Zung" get the same key. Accents are folded first like in the
+// other text ops, so đ reads as d: "Đức", "Dúc" and "Duc" typed without
+// accents sound alike
+func phoneticKey(str string) string {
+	tokens := tokenize(ascii.Convert(strings.ToLower(str)))
+	for i, token := range tokens {
+		// collapse repeated letters: "thanhh" => "thanh"
+		var b strings.Builder
+		var last rune
+		for _, ch := range token {
+			if ch != last {
+				b.WriteRune(ch)
+			}
+			last = ch
+		}
+		token = b.String()
+
+		for _, rule := range phoneticInitials {
+			if strings.HasPrefix(token, rule[0]) {
+				token = rule[1] + token[len(rule[0]):]
+				break
+			}
+		}
+		for _, rule := range phoneticFinals {
+			if len(token) > len(rule[0]) && strings.HasSuffix(token, rule[0]) {
+				token = token[:len(token)-len(rule[0])] + rule[1]
+				break
+			}
+		}
+		tokens[i] = strings.ReplaceAll(token, "y", "i")
+	}
+	return strings.Join(tokens, " ")
+}
@@ -0,0 +1,89 @@
+package userutil
+
+import (
+	"testing"
+
+	"github.com/subiz/header"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"thành", "thanh", 1},
+		{"lan", "lan", 0},
+	} {
+		if got := editDistance([]rune(c.a), []rune(c.b)); got != c.want {
+			t.Errorf("%q, %q: got %d, want %d", c.a, c.b, got, c.want)
+		}
+		if got := editDistance([]rune(c.b), []rune(c.a)); got != c.want {
+			t.Errorf("%q, %q: got %d, want %d", c.b, c.a, got, c.want)
+		}
+	}
+}
+
+func TestPhoneticKey(t *testing.T) {
+	alike := [][]string{
+		{"Trần Dũng", "Chan Zung", "trần dủng"},
+		{"Đức", "Dúc", "Duc", "Giúc"},
+		{"Phương", "Fuong"},
+		{"Thanh", "Thanhh", "Thành"},
+		{"Nguyễn", "Nguyen"},
+		{"Huy", "Hui"},
+		{"Sơn", "Xơn"},
+		{"Nghĩa", "Ngĩa"},
+		{"Quang", "Cuang", "Kuan"},
+	}
+	for _, names := range alike {
+		for _, name := range names[1:] {
+			if phoneticKey(name) != phoneticKey(names[0]) {
+				t.Errorf("want %q to sound like %q, got %q and %q", name, names[0], phoneticKey(name), phoneticKey(names[0]))
+			}
+		}
+	}
+
+	for _, pair := range [][2]string{{"Lan", "Lam"}, {"Minh", "Anh"}, {"Thanh", "Thanh Lan"}} {
+		if phoneticKey(pair[0]) == phoneticKey(pair[1]) {
+			t.Errorf("want %q not to sound like %q, got %q", pair[0], pair[1], phoneticKey(pair[0]))
+		}
+	}
+}
+
+func TestFuzzyOps(t *testing.T) {
+	cases := []struct {
+		value string
+		cond  *header.TextCondition
+		want  bool
+	}{
+		// edit distances count the folded runes
+		{"Thành", &header.TextCondition{Op: "edit_distance:0", Eq: []string{"thanh"}}, true},
+		{"Thành", &header.TextCondition{Op: "edit_distance:0", Eq: []string{"thanh"}, AccentSensitive: true}, false},
+		{"Thành", &header.TextCondition{Op: "edit_distance:1", Eq: []string{"thanh"}, AccentSensitive: true}, true},
+		{"Nguyen", &header.TextCondition{Op: "edit_distance:2", Eq: []string{"lan", "ngyuen"}}, true},
+		{"Nguyen", &header.TextCondition{Op: "edit_distance:1", Eq: []string{"lan", "ngyuen"}}, false},
+
+		// similarity is the jaccard index of the token sets
+		{"Nguyen Van A", &header.TextCondition{Op: "similarity:1", Eq: []string{"van a, nguyen"}}, true},
+		{"Nguyen Van A", &header.TextCondition{Op: "similarity:0.5", Eq: []string{"nguyen van b"}}, true},
+		{"Nguyen Van A", &header.TextCondition{Op: "similarity:0.6", Eq: []string{"nguyen van b"}}, false},
+		{"Nguyen Van A", &header.TextCondition{Op: "similarity:0.25", Eq: []string{"tran thi a"}}, false},
+		{"Nguyen Van A", &header.TextCondition{Op: "similarity:0.2", Eq: []string{"tran thi a"}}, true},
+		{"", &header.TextCondition{Op: "similarity:0.1", Eq: []string{"a"}}, false},
+
+		{"Trần Dũng", &header.TextCondition{Op: "sounds_like", Eq: []string{"chan zung"}}, true},
+		{"Đức", &header.TextCondition{Op: "sounds_like", Eq: []string{"Duc"}}, true},
+		{"", &header.TextCondition{Op: "sounds_like", Eq: []string{""}}, false},
+	}
+
+	for _, c := range cases {
+		if got := EvaluateText(true, c.value, c.cond); got != c.want {
+			t.Errorf("%q %s %v: got %v, want %v", c.value, c.cond.Op, c.cond.Eq, got, c.want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/subiz/header v1.12.72
 	github.com/subiz/log v0.0.34
 	github.com/thanhpk/ascii v0.0.4
+	google.golang.org/protobuf v1.31.0
 )
 
 require (
@@ -18,5 +19,4 @@ require (
 	google.golang.org/genproto v0.0.0-20230706204954-ccb25ca9f130 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
 	google.golang.org/grpc v1.56.2 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -0,0 +1,143 @@
+package userutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/subiz/header"
+	"google.golang.org/protobuf/proto"
+)
+
+// CanonicalHash returns a hash identifying cond regardless of the order of
+// its children and operands, of attr. or attr: key prefixes and of operand
+// duplicates differing only by case or accents when the condition ignores
+// them. Combine with Simplify to also identify equivalent trees
+func CanonicalHash(cond *header.UserViewCondition) string {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(canonical(cond))
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// EqualConditions tells whether a and b have the same canonical form
+func EqualConditions(a, b *header.UserViewCondition) bool {
+	return CanonicalHash(a) == CanonicalHash(b)
+}
+
+// canonical returns the canonical form of a copy of cond, fields which
+// have no canonical form are kept as is
+func canonical(cond *header.UserViewCondition) *header.UserViewCondition {
+	if cond == nil {
+		return nil
+	}
+	out := proto.Clone(cond).(*header.UserViewCondition)
+	canonicalize(out)
+	return out
+}
+
+func canonicalize(cond *header.UserViewCondition) {
+	if strings.HasPrefix(cond.GetKey(), "attr.") {
+		cond.Key = "attr:" + cond.Key[5:]
+	}
+	cond.One = canonicalizeGroup(cond.GetOne())
+	cond.All = canonicalizeGroup(cond.GetAll())
+	canonicalizeText(cond.GetText())
+	canonicalizeFloat(cond.GetNumber())
+	canonicalizeDatetime(cond.GetDatetime())
+}
+
+// canonicalizeGroup sorts the children of a group by their canonical form,
+// dropping duplicates
+func canonicalizeGroup(children []*header.UserViewCondition) []*header.UserViewCondition {
+	if len(children) == 0 {
+		return nil
+	}
+
+	byKey := map[string]*header.UserViewCondition{}
+	keys := []string{}
+	for _, c := range children {
+		if c == nil {
+			c = &header.UserViewCondition{}
+		}
+		canonicalize(c)
+		k := conditionKey(c)
+		if byKey[k] == nil {
+			keys = append(keys, k)
+		}
+		byKey[k] = c
+	}
+	sort.Strings(keys)
+
+	out := make([]*header.UserViewCondition, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, byKey[k])
+	}
+	return out
+}
+
+// sortedSet returns the distinct strs, after norm, sorted
+func sortedSet(strs []string, norm func(string) string) []string {
+	if len(strs) == 0 {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	out := []string{}
+	for _, str := range strs {
+		str = norm(str)
+		if !seen[str] {
+			seen[str] = true
+			out = append(out, str)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func canonicalizeText(cond *header.TextCondition) {
+	if cond == nil {
+		return
+	}
+
+	m := &textMatcher{cond: cond}
+	norm := func(str string) string { return strings.TrimSpace(m.fold(str)) }
+	cond.Eq = sortedSet(cond.GetEq(), norm)
+	cond.Neq = sortedSet(cond.GetNeq(), norm)
+	cond.StartWith = sortedSet(cond.GetStartWith(), norm)
+	cond.EndWith = sortedSet(cond.GetEndWith(), norm)
+	cond.Contain = sortedSet(cond.GetContain(), norm)
+	cond.NotContain = sortedSet(cond.GetNotContain(), norm)
+	cond.NotStartWith = sortedSet(cond.GetNotStartWith(), norm)
+}
+
+func canonicalizeFloat(cond *header.FloatCondition) {
+	if cond == nil {
+		return
+	}
+
+	sortedFloats := func(fs []float64) []float64 {
+		if len(fs) == 0 {
+			return nil
+		}
+		out := []float64{}
+		seen := map[float64]bool{}
+		for _, f := range fs {
+			if !seen[f] {
+				seen[f] = true
+				out = append(out, f)
+			}
+		}
+		sort.Float64s(out)
+		return out
+	}
+	cond.Eq = sortedFloats(cond.GetEq())
+	cond.Neq = sortedFloats(cond.GetNeq())
+}
+
+func canonicalizeDatetime(cond *header.DatetimeCondition) {
+	if cond == nil {
+		return
+	}
+	cond.DaysOfWeek = sortedSet(cond.GetDaysOfWeek(), func(day string) string { return strings.ToLower(strings.TrimSpace(day)) })
+}
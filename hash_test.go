@@ -0,0 +1,55 @@
+package userutil
+
+import (
+	"testing"
+
+	"github.com/subiz/header"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCanonicalHash(t *testing.T) {
+	a := &header.UserViewCondition{All: []*header.UserViewCondition{
+		{Key: "attr.name", Text: &header.TextCondition{Op: "eq", Eq: []string{"Lan", "thành"}}},
+		{Key: "attr:score", Number: &header.FloatCondition{Op: "eq", Eq: []float64{2, 1, 2}}},
+		{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "days_of_week", DaysOfWeek: []string{"Monday", "friday"}}},
+	}}
+	b := &header.UserViewCondition{All: []*header.UserViewCondition{
+		{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "days_of_week", DaysOfWeek: []string{"Friday", " monday"}}},
+		{Key: "attr:score", Number: &header.FloatCondition{Op: "eq", Eq: []float64{1, 2}}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"Thanh ", "lan"}}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan", "THANH"}}},
+	}}
+	orig := proto.Clone(a)
+	if !EqualConditions(a, b) {
+		t.Error("want equal conditions")
+	}
+	if !proto.Equal(a, orig) {
+		t.Error("CanonicalHash must not modify the condition")
+	}
+
+	// every field counts
+	for _, c := range []*header.UserViewCondition{
+		{Key: "attr:score", Number: &header.FloatCondition{Op: "in_range", InRange: []float64{2, 1}}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan"}, CaseSensitive: true}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan"}, Transforms: []*header.TextTransform{{Name: "url_host"}, {Name: "trim"}}}},
+		{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "between", Between: []int64{2, 1}}},
+		{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan"}}, Deleted: true},
+	} {
+		changed := proto.Clone(c).(*header.UserViewCondition)
+		switch {
+		case c.Number != nil:
+			changed.Number.InRange = []float64{1, 2}
+		case c.Datetime != nil:
+			changed.Datetime.Between = []int64{1, 2}
+		case c.Deleted:
+			changed.Deleted = false
+		case c.Text.CaseSensitive:
+			changed.Text.CaseSensitive = false
+		default:
+			changed.Text.Transforms = []*header.TextTransform{{Name: "trim"}, {Name: "url_host"}}
+		}
+		if EqualConditions(c, changed) {
+			t.Errorf("%v and %v: want different hashes", c, changed)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package userutil
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/subiz/header"
+	"github.com/thanhpk/ascii"
+)
+
+// KeyValue is the value of a key on a user, only the field matching the key
+// type is set. Datetimes are unix milliseconds
+type KeyValue struct {
+	Found    bool
+	Text     string
+	List     []string
+	Number   float64
+	Datetime int64
+	Boolean  bool
+}
+
+// KeyAccessor reads a key on users. Type is one of text, list, number,
+// boolean, datetime or keyword and decides which condition evaluates the
+// key.
+// AnyValue list keys are matched value by value unless the condition has a
+// quantifier or a set op: the key matches when any value matches, or when
+// it has no value and the empty value matches. Split decodes the values of
+// text keys holding several, only quantifiers and set ops use it
+type KeyAccessor struct {
+	Type     string
+	Get      func(u *header.User) KeyValue
+	AnyValue bool
+	Split    func(text string) []string
+}
+
+// KeyResolver resolves key to its accessor, once per compilation. An error
+// means the key is known but cannot be read, e.g: an undefined attribute
+type KeyResolver func(key string, defM map[string]*header.AttributeDefinition) (*KeyAccessor, error)
+
+var keyRegistry = struct {
+	lock     sync.RWMutex
+	keys     map[string]KeyResolver
+	prefixes map[string]KeyResolver
+}{keys: map[string]KeyResolver{}, prefixes: map[string]KeyResolver{}}
+
+// RegisterKey makes key filterable and sortable, replacing any resolver
+// previously registered for it. Built-in keys are registered the same way
+func RegisterKey(key string, resolver KeyResolver) {
+	keyRegistry.lock.Lock()
+	keyRegistry.keys[key] = resolver
+	keyRegistry.lock.Unlock()
+}
+
+// RegisterKeyPrefix registers resolver for every key starting with prefix,
+// e.g: attr:. Exact keys take precedence, then the longest prefix
+func RegisterKeyPrefix(prefix string, resolver KeyResolver) {
+	keyRegistry.lock.Lock()
+	keyRegistry.prefixes[prefix] = resolver
+	keyRegistry.lock.Unlock()
+}
+
+func lookupKey(key string) KeyResolver {
+	keyRegistry.lock.RLock()
+	defer keyRegistry.lock.RUnlock()
+	if resolver := keyRegistry.keys[key]; resolver != nil {
+		return resolver
+	}
+
+	var resolver KeyResolver
+	longest := -1
+	for prefix, r := range keyRegistry.prefixes {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			resolver, longest = r, len(prefix)
+		}
+	}
+	return resolver
+}
+
+// ResolveKey returns the accessor of key, unknown keys are returned as error
+func ResolveKey(key string, defM map[string]*header.AttributeDefinition) (*KeyAccessor, error) {
+	resolver := lookupKey(key)
+	if resolver == nil {
+		return nil, fmt.Errorf("unknown key %q", key)
+	}
+	return resolver(key, defM)
+}
+
+// textKeys are the built-in single-valued text keys, each returns whether
+// the value is present and the value
+var textKeys = map[string]func(u *header.User) (bool, string){
+	"id":             func(u *header.User) (bool, string) { return true, u.GetId() },
+	"channel":        func(u *header.User) (bool, string) { return true, u.Channel },
+	"channel_source": func(u *header.User) (bool, string) { return true, u.ChannelSource },
+
+	"start_content_view:by:device:ip": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetIp()
+	},
+	"start_content_view:by:device:language": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetLanguage()
+	},
+	"start_content_view:by:device:page_title": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetPageTitle()
+	},
+	"start_content_view:by:device:page_url": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetPageUrl()
+	},
+	"start_content_view:by:device:platform": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetPlatform()
+	},
+	"start_content_view:by:device:referrer": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetReferrer()
+	},
+	"start_content_view:by:device:screen_resolution": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetScreenResolution()
+	},
+	"start_content_view:by:device:source": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetSource()
+	},
+	"start_content_view:by:device:type": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetType()
+	},
+	"start_content_view:by:device:user_agent": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUserAgent()
+	},
+	"start_content_view:by:device:utm:name": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetName()
+	},
+	"start_content_view:by:device:utm:source": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetSource()
+	},
+	"start_content_view:by:device:utm:medium": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetMedium()
+	},
+	"start_content_view:by:device:utm:term": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetTerm()
+	},
+	"start_content_view:by:device:utm:content": func(u *header.User) (bool, string) {
+		return u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetContent()
+	},
+
+	"first_content_view:by:device:ip": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetIp()
+	},
+	"first_content_view:by:device:language": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetLanguage()
+	},
+	"first_content_view:by:device:page_title": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetPageTitle()
+	},
+	"first_content_view:by:device:page_url": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetPageUrl()
+	},
+	"first_content_view:by:device:platform": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetPlatform()
+	},
+	"first_content_view:by:device:referrer": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetReferrer()
+	},
+	"first_content_view:by:device:screen_resolution": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetScreenResolution()
+	},
+	"first_content_view:by:device:source": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetSource()
+	},
+	"first_content_view:by:device:type": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetType()
+	},
+	"first_content_view:by:device:user_agent": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUserAgent()
+	},
+	"first_content_view:by:device:utm:name": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetName()
+	},
+	"first_content_view:by:device:utm:source": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetSource()
+	},
+	"first_content_view:by:device:utm:medium": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetMedium()
+	},
+	"first_content_view:by:device:utm:term": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetTerm()
+	},
+	"first_content_view:by:device:utm:content": func(u *header.User) (bool, string) {
+		return u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetContent()
+	},
+}
+
+// anyValueKeys are the list keys which have always been matched value by
+// value, see KeyAccessor.AnyValue
+var anyValueKeys = map[string]bool{"lead_owners": true, "lead_conversion_bys": true}
+
+// listKeys are the built-in multi-valued text keys, evaluated as a whole
+// with EvaluateTexts
+var listKeys = map[string]func(u *header.User) []string{
+	"labels": func(u *header.User) []string {
+		labels := []string{}
+		for _, label := range u.Labels {
+			labels = append(labels, label.Label)
+		}
+		return labels
+	},
+	"segment": func(u *header.User) []string {
+		segs := []string{}
+		for _, seg := range u.Segments {
+			segs = append(segs, seg.GetSegmentId())
+		}
+		return segs
+	},
+	"lead_owners":         func(u *header.User) []string { return u.GetLeadOwners() },
+	"lead_conversion_bys": func(u *header.User) []string { return u.GetLeadConversionBys() },
+}
+
+// keywordKey searches users by name, email, phone...: it matches users
+// whose id or any text attribute contains the keyword, ignoring case,
+// accents and spaces. Its values are the id and the attribute texts
+var keywordKey = &KeyAccessor{Type: "keyword", Get: func(u *header.User) KeyValue {
+	vals := []string{}
+	for _, attr := range u.Attributes {
+		if attr.Text != "" {
+			vals = append(vals, ascii.Convert(strings.ToLower(SpaceStringsBuilder(attr.Text))))
+		}
+	}
+	vals = append(vals, strings.TrimSpace(strings.ToLower(u.Id)))
+	return KeyValue{Found: true, List: vals}
+}}
+
+// keywordOperand returns the keyword of cond as searched in the values of
+// keywordKey. A condition without keyword matches all users
+func keywordOperand(cond *header.UserViewCondition) (string, bool) {
+	if len(cond.GetText().GetContain()) == 0 {
+		return "", false
+	}
+	return ascii.Convert(SpaceStringsBuilder(strings.ToLower(cond.GetText().GetContain()[0]))), true
+}
+
+// attrKey resolves attr:<key> and attr.<key> to the attribute defined in defM
+func attrKey(key string, defM map[string]*header.AttributeDefinition) (*KeyAccessor, error) {
+	key = key[5:]
+	def := defM[key]
+	if def == nil {
+		return nil, fmt.Errorf("attribute %q is not defined", key)
+	}
+
+	var split func(string) []string
+	typ := def.GetType()
+	switch typ {
+	case "", "text":
+		typ = "text"
+	case "list":
+		// list attributes are texts, decoded for quantifiers and set ops
+		typ, split = "text", decodeList
+	case "number", "boolean", "datetime":
+	default:
+		return nil, fmt.Errorf("attribute %q has unsupported type %q", key, def.GetType())
+	}
+	return &KeyAccessor{Type: typ, Split: split, Get: func(u *header.User) KeyValue {
+		text, num, date, boo, found := FindAttr(u, key, def.Type)
+		return KeyValue{Found: found, Text: text, Number: num, Datetime: date, Boolean: boo}
+	}}, nil
+}
+
+func init() {
+	for key, get := range textKeys {
+		get := get
+		accessor := &KeyAccessor{Type: "text", Get: func(u *header.User) KeyValue {
+			found, str := get(u)
+			return KeyValue{Found: found, Text: str}
+		}}
+		RegisterKey(key, func(string, map[string]*header.AttributeDefinition) (*KeyAccessor, error) { return accessor, nil })
+	}
+
+	for key, get := range listKeys {
+		get := get
+		accessor := &KeyAccessor{Type: "list", AnyValue: anyValueKeys[key], Get: func(u *header.User) KeyValue {
+			return KeyValue{Found: true, List: get(u)}
+		}}
+		RegisterKey(key, func(string, map[string]*header.AttributeDefinition) (*KeyAccessor, error) { return accessor, nil })
+	}
+
+	RegisterKey("keyword", func(string, map[string]*header.AttributeDefinition) (*KeyAccessor, error) { return keywordKey, nil })
+	RegisterKeyPrefix("attr:", attrKey)
+	RegisterKeyPrefix("attr.", attrKey)
+}
@@ -0,0 +1,671 @@
+package userutil
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/subiz/header"
+)
+
+// ParseQuery parses the textual form of a condition, e.g:
+//
+//	attr:email contain "gmail" AND (labels eq vip OR channel eq zalo) AND NOT attr:age lt 18
+//
+// A leaf is a key, its modifiers, an op and comma-separated values. Modifiers
+// follow the key, separated by |, they are case_sensitive, accent_sensitive
+// or a transform, e.g: attr:email|trim|email_domain eq gmail.com, modifiers
+// holding spaces, | or " are double-quoted, e.g: attr:code|"split_part:|,2".
+// Values are bare words or double-quoted strings. NOT binds tighter than AND, which binds
+// tighter than OR, keywords are case-insensitive. The sub condition is picked
+// from the key type in defM, number and datetime ops on text keys compare
+// the text as a number or a date. Ops such as eq or has_value exist for
+// several types, a first modifier as_number or as_datetime picks the number
+// or datetime sub condition, e.g: attr:order_count|as_number eq 5. "" is
+// the empty op and a key without op is a leaf without sub condition. An
+// empty query is the empty condition
+func ParseQuery(defM map[string]*header.AttributeDefinition, query string) (*header.UserViewCondition, error) {
+	p := &queryParser{defM: defM, src: query}
+	p.skipSpace()
+	if p.eof() {
+		return &header.UserViewCondition{}, nil
+	}
+
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return cond, nil
+}
+
+type queryParser struct {
+	defM map[string]*header.AttributeDefinition
+	src  string
+	pos  int
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *queryParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *queryParser) skipSpace() {
+	for !p.eof() && isQuerySpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+func isQuerySpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+// atKeyword tells whether the next word is keyword, without consuming it
+func (p *queryParser) atKeyword(keyword string) bool {
+	end := p.pos + len(keyword)
+	if end > len(p.src) || !strings.EqualFold(p.src[p.pos:end], keyword) {
+		return false
+	}
+	return end == len(p.src) || isQuerySpace(p.src[end]) || p.src[end] == '('
+}
+
+func (p *queryParser) keyword(keyword string) bool {
+	p.skipSpace()
+	if !p.atKeyword(keyword) {
+		return false
+	}
+	p.pos += len(keyword)
+	return true
+}
+
+// word reads a bare word, keys and ops may contain commas, e.g:
+// compare:lt,attr:invoice_amount, values may not
+func (p *queryParser) word(comma bool) string {
+	start := p.pos
+	for !p.eof() {
+		c := p.src[p.pos]
+		if isQuerySpace(c) || c == '(' || c == ')' || c == '"' || (c == ',' && !comma) {
+			break
+		}
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *queryParser) parseOr() (*header.UserViewCondition, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*header.UserViewCondition{first}
+	for p.keyword("OR") {
+		child, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &header.UserViewCondition{One: children}, nil
+}
+
+func (p *queryParser) parseAnd() (*header.UserViewCondition, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*header.UserViewCondition{first}
+	for p.keyword("AND") {
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &header.UserViewCondition{All: children}, nil
+}
+
+func (p *queryParser) parseUnary() (*header.UserViewCondition, error) {
+	if p.keyword("NOT") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negate(inner), nil
+	}
+
+	p.skipSpace()
+	if p.peek() != '(' {
+		return p.parseLeaf()
+	}
+
+	p.pos++
+	p.skipSpace()
+	if p.peek() == ')' {
+		p.pos++
+		return &header.UserViewCondition{}, nil
+	}
+
+	inner, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.peek() != ')' {
+		return nil, p.errorf("expected )")
+	}
+	p.pos++
+	return inner, nil
+}
+
+// negate returns the negation node of cond
+func negate(cond *header.UserViewCondition) *header.UserViewCondition {
+	if cond.GetKey() == "" && len(cond.GetOne()) > 0 {
+		return &header.UserViewCondition{Key: NotKey, One: cond.GetOne()}
+	}
+	if cond.GetKey() == "" && len(cond.GetAll()) > 0 {
+		return &header.UserViewCondition{Key: NotKey, All: cond.GetAll()}
+	}
+	if cond.GetKey() == "" {
+		return &header.UserViewCondition{Key: NotKey}
+	}
+	return &header.UserViewCondition{Key: NotKey, All: []*header.UserViewCondition{cond}}
+}
+
+// modifier reads a key or a modifier, up to the next |
+func (p *queryParser) modifier() (string, error) {
+	if p.peek() == '"' {
+		return p.quoted()
+	}
+
+	start := p.pos
+	for !p.eof() {
+		c := p.src[p.pos]
+		if isQuerySpace(c) || c == '(' || c == ')' || c == '"' || c == '|' {
+			break
+		}
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected a modifier")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *queryParser) parseLeaf() (*header.UserViewCondition, error) {
+	if p.peek() == '"' || p.peek() == '|' {
+		return nil, p.errorf("expected a key")
+	}
+	key, err := p.modifier()
+	if err != nil {
+		return nil, p.errorf("expected a key")
+	}
+
+	var modifiers []string
+	for p.peek() == '|' {
+		p.pos++
+		modifier, err := p.modifier()
+		if err != nil {
+			return nil, err
+		}
+		modifiers = append(modifiers, modifier)
+	}
+
+	var as string
+	if len(modifiers) > 0 && (modifiers[0] == "as_number" || modifiers[0] == "as_datetime") {
+		as, modifiers = strings.TrimPrefix(modifiers[0], "as_"), modifiers[1:]
+	}
+
+	p.skipSpace()
+	if len(modifiers) == 0 && as == "" && (p.eof() || p.peek() == ')' || p.atKeyword("AND") || p.atKeyword("OR")) {
+		if _, err := ResolveKey(key, p.defM); err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return &header.UserViewCondition{Key: key}, nil
+	}
+
+	var op string
+	if p.peek() == '"' {
+		if op, err = p.quoted(); err != nil {
+			return nil, err
+		}
+		if op != "" {
+			return nil, p.errorf("ops are bare words, only the empty op is quoted")
+		}
+	} else if op = p.word(true); op == "" {
+		return nil, p.errorf("expected an op after %q", key)
+	}
+
+	values, err := p.values()
+	if err != nil {
+		return nil, err
+	}
+
+	accessor, err := ResolveKey(key, p.defM)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	typ := accessor.Type
+
+	name := queryOpName(op)
+	switch {
+	case as != "":
+		if typ != "text" && typ != as {
+			return nil, p.errorf("as_%s applies to text and %s keys, %q is %s", as, as, key, typ)
+		}
+		typ = as
+	case typ == "text" && impliesNumber(name):
+		typ = "number"
+	case typ == "text" && impliesDatetime(name):
+		typ = "datetime"
+	}
+
+	cond := &header.UserViewCondition{Key: key}
+	switch typ {
+	case "text", "list", "keyword":
+		cond.Text, err = parseTextQuery(op, modifiers, values)
+	case "number":
+		cond.Number, err = parseFloatQuery(op, modifiers, values)
+	case "datetime":
+		cond.Datetime, err = parseDatetimeQuery(op, modifiers, values)
+	case "boolean":
+		cond.Boolean = &header.BoolCondition{Op: op}
+		if len(modifiers) > 0 || len(values) > 0 {
+			err = fmt.Errorf("%s takes no modifier nor value", op)
+		}
+	default:
+		err = fmt.Errorf("key %q has unsupported type %q", key, typ)
+	}
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	return cond, nil
+}
+
+// values reads the comma-separated values of a leaf, up to the next keyword,
+// parenthesis or the end of the query
+func (p *queryParser) values() ([]string, error) {
+	var values []string
+	more := false
+	for {
+		p.skipSpace()
+		if p.eof() || p.peek() == ')' || p.atKeyword("AND") || p.atKeyword("OR") {
+			if more {
+				return nil, p.errorf("expected a value after ,")
+			}
+			return values, nil
+		}
+
+		if p.peek() == '"' {
+			value, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		} else {
+			value := p.word(false)
+			if value == "" {
+				return nil, p.errorf("expected a value")
+			}
+			values = append(values, value)
+		}
+
+		p.skipSpace()
+		if p.peek() != ',' {
+			return values, nil
+		}
+		p.pos++
+		more = true
+	}
+}
+
+func (p *queryParser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+	for !p.eof() {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case '"':
+			p.pos++
+			value, err := strconv.Unquote(p.src[start:p.pos])
+			if err != nil {
+				p.pos = start
+				return "", p.errorf("invalid string %s", p.src[start:])
+			}
+			return value, nil
+		}
+		p.pos++
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+// impliesNumber tells whether op on a text key compares the text as a
+// number without as_number modifier
+func impliesNumber(op string) bool {
+	return !hasOp(textOps, op) && hasOp(floatOps, op)
+}
+
+// impliesDatetime tells whether op on a text key compares the text as a
+// date without as_datetime modifier
+func impliesDatetime(op string) bool {
+	return !hasOp(textOps, op) && !hasOp(floatOps, op) && hasOp(datetimeOps, op)
+}
+
+// queryOpName strips the quantifier and the arguments of op
+func queryOpName(op string) string {
+	_, _, name, _ := splitQuantifier(op)
+	name, _ = splitOp(name)
+	return name
+}
+
+func parseTextQuery(op string, modifiers, values []string) (*header.TextCondition, error) {
+	cond := &header.TextCondition{Op: op}
+	for _, modifier := range modifiers {
+		switch modifier {
+		case "case_sensitive":
+			cond.CaseSensitive = true
+		case "accent_sensitive":
+			cond.AccentSensitive = true
+		default:
+			cond.Transforms = append(cond.Transforms, &header.TextTransform{Name: modifier})
+		}
+	}
+
+	name := queryOpName(op)
+	if name == "regex" {
+		if len(values) != 1 {
+			return nil, fmt.Errorf("regex requires one pattern")
+		}
+		cond.Regex = values[0]
+		return cond, nil
+	}
+
+	switch textOperandField(name) {
+	case "eq":
+		cond.Eq = values
+	case "neq":
+		cond.Neq = values
+	case "start_with":
+		cond.StartWith = values
+	case "end_with":
+		cond.EndWith = values
+	case "contain":
+		cond.Contain = values
+	case "not_contain":
+		cond.NotContain = values
+	case "not_start_with":
+		cond.NotStartWith = values
+	default:
+		if len(values) > 0 {
+			return nil, fmt.Errorf("%s takes no value", op)
+		}
+	}
+	return cond, nil
+}
+
+func parseFloatQuery(op string, modifiers, values []string) (*header.FloatCondition, error) {
+	cond := &header.FloatCondition{Op: op}
+	for _, modifier := range modifiers {
+		cond.Transforms = append(cond.Transforms, &header.FloatTransform{Name: modifier})
+	}
+
+	if op == "has_value" {
+		if len(values) > 1 {
+			return nil, fmt.Errorf("has_value takes at most one value")
+		}
+		cond.HasValue = len(values) == 0 || values[0] == "true"
+		return cond, nil
+	}
+
+	nums, ok := floatArgs(values)
+	if !ok {
+		return nil, fmt.Errorf("%s requires numbers", op)
+	}
+
+	single := func(dst *float64) error {
+		if len(nums) != 1 {
+			return fmt.Errorf("%s requires one value", op)
+		}
+		*dst = nums[0]
+		return nil
+	}
+
+	switch op {
+	case "eq":
+		cond.Eq = nums
+	case "neq":
+		cond.Neq = nums
+	case "gt":
+		return cond, single(&cond.Gt)
+	case "lt":
+		return cond, single(&cond.Lt)
+	case "gte":
+		return cond, single(&cond.Gte)
+	case "lte":
+		return cond, single(&cond.Lte)
+	case "in_range":
+		cond.InRange = nums
+	case "not_in_range":
+		cond.NotInRange = nums
+	default:
+		if len(values) > 0 {
+			return nil, fmt.Errorf("%s takes no value", op)
+		}
+	}
+	return cond, nil
+}
+
+func parseDatetimeQuery(op string, modifiers, values []string) (*header.DatetimeCondition, error) {
+	cond := &header.DatetimeCondition{Op: op}
+	if len(modifiers) > 0 {
+		return nil, fmt.Errorf("%s takes no modifier", op)
+	}
+
+	if op == "days_of_week" {
+		cond.DaysOfWeek = values
+		return cond, nil
+	}
+
+	ints := []int64{}
+	for _, value := range values {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s requires integers", op)
+		}
+		ints = append(ints, i)
+	}
+
+	single := func(dst *int64) error {
+		if len(ints) != 1 {
+			return fmt.Errorf("%s requires one value", op)
+		}
+		*dst = ints[0]
+		return nil
+	}
+
+	switch op {
+	case "last":
+		return cond, single(&cond.Last)
+	case "before_ago":
+		return cond, single(&cond.BeforeAgo)
+	case "after":
+		return cond, single(&cond.After)
+	case "before":
+		return cond, single(&cond.Before)
+	case "between":
+		cond.Between = ints
+	case "outside":
+		cond.Outside = ints
+	default:
+		if len(values) > 0 {
+			return nil, fmt.Errorf("%s takes no value", op)
+		}
+	}
+	return cond, nil
+}
+
+// FormatQuery prints cond in the syntax read by ParseQuery, groups nested in
+// groups are parenthesized. Number and datetime sub conditions are marked
+// as_number or as_datetime when their op does not tell their type. The
+// Deleted flag is not part of the query
+func FormatQuery(cond *header.UserViewCondition) string {
+	if isEmptyCondition(cond) {
+		return ""
+	}
+	return formatQuery(cond)
+}
+
+func isEmptyCondition(cond *header.UserViewCondition) bool {
+	return cond.GetKey() == "" && len(cond.GetOne()) == 0 && len(cond.GetAll()) == 0
+}
+
+func formatQuery(cond *header.UserViewCondition) string {
+	if cond.GetKey() == NotKey {
+		return "NOT " + formatNested(negated(cond))
+	}
+
+	if len(cond.GetOne()) > 0 {
+		return formatGroup(cond.GetOne(), " OR ")
+	}
+	if len(cond.GetAll()) > 0 {
+		return formatGroup(cond.GetAll(), " AND ")
+	}
+	if isEmptyCondition(cond) {
+		return "()"
+	}
+	return formatLeaf(cond)
+}
+
+func formatGroup(children []*header.UserViewCondition, sep string) string {
+	if len(children) == 1 {
+		return formatQuery(children[0])
+	}
+
+	parts := make([]string, 0, len(children))
+	for _, c := range children {
+		parts = append(parts, formatNested(c))
+	}
+	return strings.Join(parts, sep)
+}
+
+// formatNested parenthesizes groups of more than one condition, groups of a
+// single condition are printed as the condition
+func formatNested(cond *header.UserViewCondition) string {
+	for cond.GetKey() == "" && len(cond.GetOne())+len(cond.GetAll()) == 1 {
+		if len(cond.GetOne()) == 1 {
+			cond = cond.GetOne()[0]
+		} else {
+			cond = cond.GetAll()[0]
+		}
+	}
+
+	if cond.GetKey() == "" && (len(cond.GetOne()) > 1 || len(cond.GetAll()) > 1) {
+		return "(" + formatQuery(cond) + ")"
+	}
+	return formatQuery(cond)
+}
+
+func formatLeaf(cond *header.UserViewCondition) string {
+	key := cond.GetKey()
+	var op string
+	var values []string
+	switch {
+	case cond.GetText() != nil:
+		text := cond.GetText()
+		op = text.GetOp()
+		if text.GetCaseSensitive() {
+			key += "|case_sensitive"
+		}
+		if text.GetAccentSensitive() {
+			key += "|accent_sensitive"
+		}
+		for _, transform := range text.GetTransforms() {
+			key += "|" + quoteQueryModifier(transform.GetName())
+		}
+		operands := textOperands(text, textOperandField(queryOpName(op)))
+		if queryOpName(op) == "regex" {
+			operands = []string{text.GetRegex()}
+		}
+		for _, operand := range operands {
+			values = append(values, quoteQueryValue(operand))
+		}
+	case cond.GetNumber() != nil:
+		number := cond.GetNumber()
+		op = number.GetOp()
+		if !impliesNumber(queryOpName(op)) {
+			key += "|as_number"
+		}
+		for _, transform := range number.GetTransforms() {
+			key += "|" + quoteQueryModifier(transform.GetName())
+		}
+		if op == "has_value" && !number.GetHasValue() {
+			values = []string{"false"}
+		} else if op != "has_value" {
+			values = floatOperands(number)
+		}
+	case cond.GetDatetime() != nil:
+		op = cond.GetDatetime().GetOp()
+		if !impliesDatetime(queryOpName(op)) {
+			key += "|as_datetime"
+		}
+		// ops with arguments, e.g: next:3600, hold no value
+		if name, _ := splitOp(op); name == op {
+			for _, operand := range datetimeOperands(cond.GetDatetime()) {
+				values = append(values, quoteQueryValue(operand))
+			}
+		}
+	case cond.GetBoolean() != nil:
+		op = cond.GetBoolean().GetOp()
+	default:
+		return key
+	}
+
+	if op == "" {
+		op = `""`
+	}
+	if len(values) == 0 {
+		return key + " " + op
+	}
+	return key + " " + op + " " + strings.Join(values, ", ")
+}
+
+var bareQueryValue = regexp.MustCompile(`^[\p{L}\p{N}_.@+\-:/]+$`)
+
+// quoteQueryValue double-quotes values which would not read back as a single
+// bare word
+func quoteQueryValue(value string) string {
+	upper := strings.ToUpper(value)
+	if !bareQueryValue.MatchString(value) || upper == "AND" || upper == "OR" || upper == "NOT" {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// quoteQueryModifier double-quotes modifiers which would not read back as
+// a single modifier
+func quoteQueryModifier(modifier string) string {
+	if modifier == "" || strings.ContainsAny(modifier, " \t\n\r()\"|") {
+		return strconv.Quote(modifier)
+	}
+	return modifier
+}
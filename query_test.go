@@ -0,0 +1,242 @@
+package userutil
+
+import (
+	"testing"
+
+	"github.com/subiz/header"
+	"google.golang.org/protobuf/proto"
+)
+
+// queryLeaf builds a leaf using op or transform name of kind, with operands
+// which need quoting
+func queryLeaf(kind, name string) *header.UserViewCondition {
+	operands := []string{"x y", "a|b", `q"`, "AND", "(1)", "ä"}
+	switch kind {
+	case "text", "text transform":
+		text := &header.TextCondition{Op: name}
+		if kind == "text transform" {
+			text = &header.TextCondition{Op: "eq", Eq: operands, Transforms: []*header.TextTransform{{Name: "trim"}, {Name: name}}}
+		}
+		switch textOperandField(queryOpName(text.Op)) {
+		case "eq":
+			text.Eq = operands
+		case "neq":
+			text.Neq = operands
+		case "start_with":
+			text.StartWith = operands
+		case "end_with":
+			text.EndWith = operands
+		case "contain":
+			text.Contain = operands
+		case "not_contain":
+			text.NotContain = operands
+		case "not_start_with":
+			text.NotStartWith = operands
+		}
+		if queryOpName(text.Op) == "regex" {
+			text.Regex = `^a|b "c"$`
+		}
+		return &header.UserViewCondition{Key: "labels", Text: text}
+	case "number", "number transform":
+		number := &header.FloatCondition{Op: name}
+		if kind == "number transform" {
+			number = &header.FloatCondition{Op: "gt", Transforms: []*header.FloatTransform{{Name: name}}}
+		}
+		switch number.Op {
+		case "eq":
+			number.Eq = []float64{1, -2.5}
+		case "neq":
+			number.Neq = []float64{1e21}
+		case "gt":
+			number.Gt = 0.1
+		case "lt":
+			number.Lt = -3
+		case "gte":
+			number.Gte = 2
+		case "lte":
+			number.Lte = 0
+		case "in_range":
+			number.InRange = []float64{1, 2}
+		case "not_in_range":
+			number.NotInRange = []float64{-1, 1}
+		case "has_value":
+			number.HasValue = true
+		}
+		return &header.UserViewCondition{Key: "attr:score", Number: number}
+	case "boolean":
+		return &header.UserViewCondition{Key: "attr:vip", Boolean: &header.BoolCondition{Op: name}}
+	}
+
+	date := &header.DatetimeCondition{Op: name}
+	switch name {
+	case "last":
+		date.Last = 3600
+	case "before_ago":
+		date.BeforeAgo = 60
+	case "after":
+		date.After = 1690000000000
+	case "before":
+		date.Before = -1
+	case "between":
+		date.Between = []int64{1, 2}
+	case "outside":
+		date.Outside = []int64{1, 2}
+	case "days_of_week":
+		date.DaysOfWeek = []string{"Monday", "Friday"}
+	}
+	return &header.UserViewCondition{Key: "attr:seen", Datetime: date}
+}
+
+// TestQueryRoundTrip formats and parses back a leaf for every op and
+// transform, see the tables in validate.go
+func TestQueryRoundTrip(t *testing.T) {
+	withArgs := map[string][]string{
+		"text edit_distance":                 {"edit_distance:2"},
+		"text similarity":                    {"similarity:0.8"},
+		"text length_eq":                     {"length_eq:10"},
+		"text length_gt":                     {"length_gt:3"},
+		"text length_lt":                     {"length_lt:3"},
+		"text size_eq":                       {"size_eq:0"},
+		"text size_gt":                       {"size_gt:1"},
+		"text size_lt":                       {"size_lt:1"},
+		"text transform normalize_phone":     {"normalize_phone", "normalize_phone:e164,+84"},
+		"text transform substring":           {"substring:-3", "substring:1,3"},
+		"text transform split_part":          {"split_part:,,,-1", "split_part: ,2", "split_part:|,2", `split_part:" (,1`},
+		"number transform round":             {"round", "round:2"},
+		"number transform multiply":          {"multiply:-0.5"},
+		"number transform divide":            {"divide:1000"},
+		"number transform clamp":             {"clamp:0,10"},
+		"datetime anniversary_in_next":       {"anniversary_in_next:30"},
+		"datetime month_is":                  {"month_is:jan,December,12"},
+		"datetime day_of_month_is":           {"day_of_month_is:15,31"},
+		"datetime next":                      {"next:3600"},
+		"datetime after_from_now":            {"after_from_now:60"},
+		"datetime time_of_day":               {"time_of_day:22:00,06:00"},
+		"datetime business_hours_last":       {"business_hours_last:3600"},
+		"datetime business_hours_before_ago": {"business_hours_before_ago:0"},
+	}
+	tables := map[string]map[string]opGrammar{
+		"text": textOps, "number": floatOps, "boolean": boolOps, "datetime": datetimeOps,
+		"text transform": textTransforms, "number transform": floatTransforms,
+	}
+
+	conds := []*header.UserViewCondition{}
+	for kind, table := range tables {
+		for name, grammar := range table {
+			ops := []string{name}
+			if grammar.args != "" {
+				ops = withArgs[kind+" "+name]
+				if len(ops) == 0 {
+					t.Errorf("%s %s takes %s, add it to the round trip cases", kind, name, grammar.usage(name))
+				}
+			}
+			for _, op := range ops {
+				conds = append(conds, queryLeaf(kind, op))
+			}
+		}
+	}
+
+	hasValue := queryLeaf("number", "has_value")
+	hasValue.Number.HasValue = false
+	text := &header.TextCondition{Op: "eq", Eq: []string{"x"}, CaseSensitive: true, AccentSensitive: true,
+		Transforms: []*header.TextTransform{{Name: "split_part:|,2"}, {Name: "substring:1,3"}}}
+	conds = append(conds,
+		hasValue,
+		queryLeaf("text", "all/contain"),
+		queryLeaf("text", "at_least:2/eq"),
+		&header.UserViewCondition{Key: "attr:name", Text: text},
+		&header.UserViewCondition{Key: "keyword", Text: &header.TextCondition{Op: "contain", Contain: []string{"thành nguyễn"}}},
+		&header.UserViewCondition{Key: NotKey, One: []*header.UserViewCondition{queryLeaf("boolean", "true"), queryLeaf("text", "eq")}},
+	)
+
+	defM := map[string]*header.AttributeDefinition{
+		"name":  {Key: "name", Type: "text"},
+		"score": {Key: "score", Type: "number"},
+		"vip":   {Key: "vip", Type: "boolean"},
+		"seen":  {Key: "seen", Type: "datetime"},
+	}
+	for _, cond := range conds {
+		query := FormatQuery(cond)
+		parsed, err := ParseQuery(defM, query)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if !proto.Equal(parsed, cond) {
+			t.Errorf("%s: parsed as %v, want %v", query, parsed, cond)
+		}
+	}
+}
+
+func TestParseQueryModifiers(t *testing.T) {
+	cond, err := ParseQuery(nil, `id|trim|"split_part: ,2"|"a\"b" eq x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"trim", "split_part: ,2", `a"b`}
+	if len(cond.GetText().GetTransforms()) != len(want) {
+		t.Fatalf("got %v, want %v", cond.GetText().GetTransforms(), want)
+	}
+	for i, transform := range cond.GetText().GetTransforms() {
+		if transform.GetName() != want[i] {
+			t.Errorf("modifier %d: got %q, want %q", i, transform.GetName(), want[i])
+		}
+	}
+
+	for _, query := range []string{`id| eq x`, `id|"trim eq x`, `id|| eq x`, `|trim eq x`} {
+		if _, err := ParseQuery(nil, query); err == nil {
+			t.Errorf("%s: want an error", query)
+		}
+	}
+}
+
+func TestQueryTypeMarkers(t *testing.T) {
+	defM := map[string]*header.AttributeDefinition{
+		"order_count": {Key: "order_count", Type: "text"},
+		"score":       {Key: "score", Type: "number"},
+		"seen":        {Key: "seen", Type: "datetime"},
+		"vip":         {Key: "vip", Type: "boolean"},
+	}
+	cases := map[string]*header.UserViewCondition{
+		// ops of several types keep the sub condition of text keys
+		`attr:order_count|as_number eq 5`:           {Key: "attr:order_count", Number: &header.FloatCondition{Op: "eq", Eq: []float64{5}}},
+		`attr:order_count|as_number|round neq 1, 2`: {Key: "attr:order_count", Number: &header.FloatCondition{Op: "neq", Neq: []float64{1, 2}, Transforms: []*header.FloatTransform{{Name: "round"}}}},
+		`attr:order_count|as_number has_value`:      {Key: "attr:order_count", Number: &header.FloatCondition{Op: "has_value", HasValue: true}},
+		`attr:order_count|as_number is_empty`:       {Key: "attr:order_count", Number: &header.FloatCondition{Op: "is_empty"}},
+		`attr:order_count|as_datetime has_value`:    {Key: "attr:order_count", Datetime: &header.DatetimeCondition{Op: "has_value"}},
+		`attr:order_count eq 5`:                     {Key: "attr:order_count", Text: &header.TextCondition{Op: "eq", Eq: []string{"5"}}},
+		`attr:order_count gt 5`:                     {Key: "attr:order_count", Number: &header.FloatCondition{Op: "gt", Gt: 5}},
+		`attr:order_count today`:                    {Key: "attr:order_count", Datetime: &header.DatetimeCondition{Op: "today"}},
+		`attr:score|as_number eq 5`:                 {Key: "attr:score", Number: &header.FloatCondition{Op: "eq", Eq: []float64{5}}},
+
+		// empty ops and leaves without sub condition
+		`attr:order_count ""`:                 {Key: "attr:order_count", Text: &header.TextCondition{}},
+		`attr:order_count|as_number ""`:       {Key: "attr:order_count", Number: &header.FloatCondition{}},
+		`attr:seen|as_datetime ""`:            {Key: "attr:seen", Datetime: &header.DatetimeCondition{}},
+		`attr:vip ""`:                         {Key: "attr:vip", Boolean: &header.BoolCondition{}},
+		`attr:order_count any`:                {Key: "attr:order_count", Text: &header.TextCondition{Op: "any"}},
+		`attr:order_count`:                    {Key: "attr:order_count"},
+		`attr:order_count AND attr:vip true`:  {All: []*header.UserViewCondition{{Key: "attr:order_count"}, {Key: "attr:vip", Boolean: &header.BoolCondition{Op: "true"}}}},
+		`NOT (attr:score OR attr:seen today)`: {Key: NotKey, One: []*header.UserViewCondition{{Key: "attr:score"}, {Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "today"}}}},
+	}
+
+	for query, cond := range cases {
+		if got := FormatQuery(cond); got != query {
+			t.Errorf("%v: formatted as %s, want %s", cond, got, query)
+		}
+		parsed, err := ParseQuery(defM, query)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if !proto.Equal(parsed, cond) {
+			t.Errorf("%s: parsed as %v, want %v", query, parsed, cond)
+		}
+	}
+
+	for _, query := range []string{`attr:vip|as_number eq 1`, `attr:seen|as_number eq 1`, `attr:score|as_datetime today`, `attr:score "eq"`, `attr:score|round`, `attr:missing`} {
+		if _, err := ParseQuery(defM, query); err == nil {
+			t.Errorf("%s: want an error", query)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package userutil
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// RegexCacheSize is the maximum number of compiled patterns kept in memory
+const RegexCacheSize = 1024
+
+var regexCache = &regexpCache{m: map[string]*regexp.Regexp{}}
+
+// regexpCache shares compiled patterns across evaluations, when full the
+// oldest pattern is evicted first
+type regexpCache struct {
+	lock sync.Mutex
+	m    map[string]*regexp.Regexp
+	keys []string
+}
+
+func (c *regexpCache) get(pattern string) (*regexp.Regexp, error) {
+	c.lock.Lock()
+	re := c.m[pattern]
+	c.lock.Unlock()
+	if re != nil {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %v", pattern, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, has := c.m[pattern]; has {
+		return re, nil
+	}
+	if len(c.keys) >= RegexCacheSize {
+		delete(c.m, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.m[pattern] = re
+	c.keys = append(c.keys, pattern)
+	return re, nil
+}
+
+// CompileRegex returns the compiled pattern from the shared cache, invalid
+// patterns are returned as error
+func CompileRegex(pattern string) (*regexp.Regexp, error) {
+	return regexCache.get(pattern)
+}
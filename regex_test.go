@@ -0,0 +1,83 @@
+package userutil
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/subiz/header"
+)
+
+func TestRegex(t *testing.T) {
+	cases := []struct {
+		value string
+		cond  *header.TextCondition
+		want  bool
+	}{
+		// values and pattern are folded unless the condition is sensitive
+		{"Nguyễn Văn A", &header.TextCondition{Op: "regex", Regex: "^nguyen van"}, true},
+		{"Nguyễn Văn A", &header.TextCondition{Op: "regex", Regex: "^nguyễn"}, true},
+		{"Nguyen", &header.TextCondition{Op: "regex", Regex: "^nguyen", CaseSensitive: true}, false},
+		{"nguyen", &header.TextCondition{Op: "regex", Regex: "^nguyen", CaseSensitive: true}, true},
+		{"nguyễn", &header.TextCondition{Op: "regex", Regex: "^nguyen$", AccentSensitive: true}, false},
+		{"Nguyễn", &header.TextCondition{Op: "regex", Regex: "^nguyễn$", AccentSensitive: true}, true},
+		{"A-B", &header.TextCondition{Op: "regex", Regex: `^a\Wb$`}, true},
+
+		// the pattern matches the transformed value
+		{"Lan@Acme.com", &header.TextCondition{Op: "regex", Regex: `^acme\.com$`, Transforms: []*header.TextTransform{{Name: "email_domain"}}}, true},
+		{"0912.345.678", &header.TextCondition{Op: "regex", Regex: `^0912345`, Transforms: []*header.TextTransform{{Name: "normalize_phone"}}}, true},
+		{"0912.345.678", &header.TextCondition{Op: "regex", Regex: `^0912345`}, false},
+		{"  padded  ", &header.TextCondition{Op: "regex", Regex: `^padded$`}, true},
+	}
+
+	for _, c := range cases {
+		if got := EvaluateText(true, c.value, c.cond); got != c.want {
+			t.Errorf("%q regex %q %v: got %v, want %v", c.value, c.cond.Regex, c.cond.Transforms, got, c.want)
+		}
+	}
+}
+
+func TestRegexCompileError(t *testing.T) {
+	cond := &header.UserViewCondition{Key: "id", Text: &header.TextCondition{Op: "regex", Regex: "(lan"}}
+	if _, err := Compile(nil, nil, cond); err == nil || !strings.Contains(err.Error(), "invalid regex") {
+		t.Errorf("want an invalid regex error, got %v", err)
+	}
+	if _, err := CompileRegex("(lan"); err == nil {
+		t.Error("want an error")
+	}
+}
+
+func TestRegexCacheEviction(t *testing.T) {
+	c := &regexpCache{m: map[string]*regexp.Regexp{}}
+	pattern := func(i int) string { return "^p" + strconv.Itoa(i) + "$" }
+	for i := 0; i < RegexCacheSize; i++ {
+		if _, err := c.get(pattern(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := c.m[pattern(0)]
+
+	// hits do not refresh a pattern, the oldest inserted goes first
+	if re, _ := c.get(pattern(0)); re != first {
+		t.Error("want the cached pattern")
+	}
+	c.get(pattern(RegexCacheSize))
+	if len(c.m) != RegexCacheSize || len(c.keys) != RegexCacheSize {
+		t.Fatalf("want %d patterns, got %d, %d keys", RegexCacheSize, len(c.m), len(c.keys))
+	}
+	if _, has := c.m[pattern(0)]; has {
+		t.Error("want the oldest pattern evicted")
+	}
+	if _, has := c.m[pattern(1)]; !has {
+		t.Error("want the second pattern kept")
+	}
+
+	c.get(pattern(0))
+	if _, has := c.m[pattern(1)]; has {
+		t.Error("want the second pattern evicted once the first is back")
+	}
+	if c.keys[len(c.keys)-1] != pattern(0) {
+		t.Errorf("want the first pattern last, got %s", c.keys[len(c.keys)-1])
+	}
+}
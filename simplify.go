@@ -0,0 +1,202 @@
+package userutil
+
+import (
+	"github.com/subiz/header"
+	"google.golang.org/protobuf/proto"
+)
+
+// Simplify returns an equivalent condition with nested groups of the same
+// kind flattened, any leaves, duplicate leaves and single-child groups
+// removed, and eq leaves on the same key inside a One merged into a single
+// eq list. Trivial branches are folded: the empty condition is true and a
+// negation of the empty condition is false. cond is not modified
+func Simplify(cond *header.UserViewCondition) *header.UserViewCondition {
+	out := simplify(cond)
+	if !cond.GetDeleted() {
+		return out
+	}
+	return &header.UserViewCondition{
+		Key: out.GetKey(), One: out.GetOne(), All: out.GetAll(),
+		Text: out.GetText(), Number: out.GetNumber(), Boolean: out.GetBoolean(), Datetime: out.GetDatetime(),
+		Deleted: true,
+	}
+}
+
+func isTrue(cond *header.UserViewCondition) bool { return isEmptyCondition(cond) }
+
+func isFalse(cond *header.UserViewCondition) bool {
+	return cond.GetKey() == NotKey && len(cond.GetOne()) == 0 && len(cond.GetAll()) == 0
+}
+
+// isAnyLeaf tells whether the leaf matches every user, all its sub
+// conditions have the any op. Keys which do not resolve without attribute
+// definitions are kept, undefined attributes match no user, and so are
+// keyword leaves, which search their operand whatever the op
+func isAnyLeaf(cond *header.UserViewCondition) bool {
+	accessor, err := ResolveKey(cond.GetKey(), nil)
+	if err != nil || accessor.Type == "keyword" {
+		return false
+	}
+
+	ops := []string{}
+	if cond.GetText() != nil {
+		ops = append(ops, cond.GetText().GetOp())
+	}
+	if cond.GetDatetime() != nil {
+		ops = append(ops, cond.GetDatetime().GetOp())
+	}
+	if cond.GetNumber() != nil || cond.GetBoolean() != nil || len(ops) == 0 {
+		return false
+	}
+	for _, op := range ops {
+		if op != "any" {
+			return false
+		}
+	}
+	return true
+}
+
+func simplify(cond *header.UserViewCondition) *header.UserViewCondition {
+	if cond.GetKey() == NotKey {
+		inner := simplify(negated(cond))
+		if isTrue(inner) {
+			return &header.UserViewCondition{Key: NotKey}
+		}
+		if isFalse(inner) {
+			return &header.UserViewCondition{}
+		}
+		if inner.GetKey() == NotKey {
+			// double negation
+			return simplify(negated(inner))
+		}
+		return negate(inner)
+	}
+
+	if len(cond.GetOne()) > 0 {
+		return simplifyGroup(cond.GetOne(), true)
+	}
+	if len(cond.GetAll()) > 0 {
+		return simplifyGroup(cond.GetAll(), false)
+	}
+	if cond.GetKey() == "" || isAnyLeaf(cond) {
+		return &header.UserViewCondition{}
+	}
+	return cond
+}
+
+// simplifyGroup simplifies the children of a One (or) or an All group
+func simplifyGroup(children []*header.UserViewCondition, or bool) *header.UserViewCondition {
+	var flat []*header.UserViewCondition
+	for _, c := range children {
+		c = simplify(c)
+		if c.GetKey() == "" && or && len(c.GetOne()) > 0 {
+			flat = append(flat, c.GetOne()...)
+			continue
+		}
+		if c.GetKey() == "" && !or && len(c.GetAll()) > 0 {
+			flat = append(flat, c.GetAll()...)
+			continue
+		}
+		flat = append(flat, c)
+	}
+
+	// or: true absorbs, false is neutral. and: the other way round
+	absorbing, neutral := isTrue, isFalse
+	if !or {
+		absorbing, neutral = isFalse, isTrue
+	}
+
+	seen := map[string]bool{}
+	var out []*header.UserViewCondition
+	for _, c := range flat {
+		if absorbing(c) {
+			return c
+		}
+		if neutral(c) {
+			continue
+		}
+		h := conditionKey(c)
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		out = append(out, c)
+	}
+
+	// X and NOT X
+	for _, c := range out {
+		if c.GetKey() == NotKey && len(c.GetAll()) == 1 && seen[conditionKey(c.GetAll()[0])] {
+			if or {
+				return &header.UserViewCondition{}
+			}
+			return &header.UserViewCondition{Key: NotKey}
+		}
+	}
+
+	if or {
+		out = mergeEqLeaves(out)
+	}
+
+	switch len(out) {
+	case 0:
+		if or {
+			return &header.UserViewCondition{Key: NotKey}
+		}
+		return &header.UserViewCondition{}
+	case 1:
+		return out[0]
+	}
+	if or {
+		return &header.UserViewCondition{One: out}
+	}
+	return &header.UserViewCondition{All: out}
+}
+
+// conditionKey identifies identical conditions
+func conditionKey(cond *header.UserViewCondition) string {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(cond)
+	return string(b)
+}
+
+// mergeEqLeaves merges the text eq leaves of a One on the same key with the
+// same options into the first of them
+func mergeEqLeaves(children []*header.UserViewCondition) []*header.UserViewCondition {
+	merged := map[string]*header.UserViewCondition{}
+	var out []*header.UserViewCondition
+	for _, c := range children {
+		text := c.GetText()
+		if c.GetKey() == "" || c.GetKey() == NotKey || text.GetOp() != "eq" || len(text.GetEq()) == 0 ||
+			c.GetNumber() != nil || c.GetBoolean() != nil || c.GetDatetime() != nil {
+			out = append(out, c)
+			continue
+		}
+
+		options := conditionKey(&header.UserViewCondition{Key: c.GetKey(), Text: &header.TextCondition{
+			Op: "eq", CaseSensitive: text.GetCaseSensitive(), AccentSensitive: text.GetAccentSensitive(), Transforms: text.GetTransforms(),
+		}})
+		first := merged[options]
+		if first == nil {
+			first = &header.UserViewCondition{Key: c.GetKey(), Text: &header.TextCondition{
+				Op: "eq", CaseSensitive: text.GetCaseSensitive(), AccentSensitive: text.GetAccentSensitive(), Transforms: text.GetTransforms(),
+			}}
+			merged[options] = first
+			out = append(out, first)
+		}
+
+		for _, eq := range text.GetEq() {
+			if !containsString(first.Text.Eq, eq) {
+				first.Text.Eq = append(first.Text.Eq, eq)
+			}
+		}
+	}
+	return out
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package userutil
+
+import (
+	"testing"
+
+	"github.com/subiz/header"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSimplifyKeepsLeavesWhichFilter(t *testing.T) {
+	anyLeaf := func(key string) *header.UserViewCondition {
+		return &header.UserViewCondition{Key: key, Text: &header.TextCondition{Op: "any", Contain: []string{"lan"}}}
+	}
+	eq := &header.UserViewCondition{Key: "channel", Text: &header.TextCondition{Op: "eq", Eq: []string{"web"}}}
+
+	cases := []struct {
+		cond, want *header.UserViewCondition
+	}{
+		// resolvable keys with the any op match every user
+		{&header.UserViewCondition{All: []*header.UserViewCondition{anyLeaf("channel"), eq}}, eq},
+		{&header.UserViewCondition{All: []*header.UserViewCondition{anyLeaf("labels"), eq}}, eq},
+		// keyword leaves search their operand whatever the op
+		{&header.UserViewCondition{All: []*header.UserViewCondition{anyLeaf("keyword"), eq}}, &header.UserViewCondition{All: []*header.UserViewCondition{anyLeaf("keyword"), eq}}},
+		// attributes are not defined without defM, they may match no user
+		{&header.UserViewCondition{All: []*header.UserViewCondition{anyLeaf("attr:name"), eq}}, &header.UserViewCondition{All: []*header.UserViewCondition{anyLeaf("attr:name"), eq}}},
+		{anyLeaf("unknown"), anyLeaf("unknown")},
+		// duplicates are found whatever the field order
+		{&header.UserViewCondition{One: []*header.UserViewCondition{eq, proto.Clone(eq).(*header.UserViewCondition)}}, eq},
+	}
+	for i, c := range cases {
+		if got := Simplify(c.cond); !proto.Equal(got, c.want) {
+			t.Errorf("case %d: got %v, want %v", i, got, c.want)
+		}
+	}
+}
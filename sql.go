@@ -0,0 +1,1215 @@
+package userutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/subiz/header"
+	apb "github.com/subiz/header/account"
+	"github.com/thanhpk/ascii"
+)
+
+// SQL dialects supported by ToSQLAt
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// ToSQLAt translates cond into a parameterized SQL boolean expression with
+// the semantics of RsCheckAt for the users of account acc, as of ctx.Now.
+// The expression filters the rows of users aliased u, e.g:
+//
+//	SELECT u.id FROM users u WHERE <expression>
+//
+// over the following tables, filled with SQLRows, all columns NOT NULL but
+// number:
+//
+//	users (id TEXT, deleted INTEGER)
+//	user_attributes (user_id TEXT, key TEXT, text_raw TEXT, text TEXT,
+//	  text_lower TEXT, text_ascii TEXT, text_folded TEXT,
+//	  has_number INTEGER, number REAL, has_datetime INTEGER,
+//	  datetime INTEGER, boolean INTEGER, local_year INTEGER,
+//	  local_month INTEGER, local_day INTEGER, local_weekday INTEGER,
+//	  local_minute INTEGER)
+//	user_list_values (user_id TEXT, key TEXT, text_raw TEXT, text TEXT,
+//	  text_lower TEXT, text_ascii TEXT, text_folded TEXT)
+//
+// user_attributes holds one row per user and single-valued key, keyed as in
+// conditions: built-in keys by name (channel), attributes as attr:<name>.
+// user_list_values holds one row per value of multi-valued keys (labels,
+// segment, keyword, ...) and of list attributes, which are also in
+// user_attributes as their text. datetime is in unix milliseconds, the
+// local_ columns are datetime in the timezone of ctx or acc and must be
+// written again when it changes.
+//
+// Transforms and text ops SQL has no equivalent for, e.g: normalize_phone,
+// regex, call SQLFunctions, which only SQLite can register. They are returned
+// as error for DialectPostgres
+func ToSQLAt(ctx *EvalContext, acc *apb.Account, defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition, dialect string) (string, []any, error) {
+	return toSQL(&sqlBuilder{ctx: ctx, acc: acc, defM: defM, dialect: dialect}, cond)
+}
+
+// ToSQL is ToSQLAt at the current time without account. Datetime ops which
+// depend on the account timezone or business hours, e.g: today,
+// in_business_hour, are returned as error
+func ToSQL(defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition, dialect string) (string, []any, error) {
+	return toSQL(&sqlBuilder{ctx: &EvalContext{Now: time.Now()}, defM: defM, dialect: dialect, noAccount: true}, cond)
+}
+
+func toSQL(b *sqlBuilder, cond *header.UserViewCondition) (string, []any, error) {
+	if b.dialect != DialectPostgres && b.dialect != DialectSQLite {
+		return "", nil, fmt.Errorf("unsupported sql dialect %q", b.dialect)
+	}
+
+	where, err := b.node(cond)
+	if err != nil {
+		return "", nil, err
+	}
+	if b.err != nil {
+		return "", nil, b.err
+	}
+
+	deleted := "u.deleted = 0"
+	if cond.GetDeleted() {
+		deleted = "u.deleted > 0"
+	}
+	return deleted + " AND " + where, b.args, nil
+}
+
+// SQLRow is a row of user_attributes, or of user_list_values when List is
+// set, as read by ToSQLAt. A NaN Number is written as NULL
+type SQLRow struct {
+	List         bool
+	Key          string
+	TextRaw      string
+	Text         string
+	TextLower    string
+	TextASCII    string
+	TextFolded   string
+	HasNumber    bool
+	Number       float64
+	HasDatetime  bool
+	Datetime     int64
+	Boolean      bool
+	LocalYear    int
+	LocalMonth   int
+	LocalDay     int
+	LocalWeekday int
+	LocalMinute  int
+}
+
+// SQLRows returns the rows mirroring user u for ToSQLAt, for every registered
+// key and every attribute in defM. Texts holding numbers or dates are parsed
+// and local dates computed in the timezone of ctx or acc
+func SQLRows(ctx *EvalContext, acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User) []SQLRow {
+	keyRegistry.lock.RLock()
+	keys := make([]string, 0, len(keyRegistry.keys)+len(defM))
+	for key := range keyRegistry.keys {
+		keys = append(keys, key)
+	}
+	keyRegistry.lock.RUnlock()
+	for name := range defM {
+		keys = append(keys, "attr:"+name)
+	}
+	sort.Strings(keys)
+
+	loc := ctx.location(acc)
+	rows := []SQLRow{}
+	for _, key := range keys {
+		accessor, err := ResolveKey(key, defM)
+		if err != nil {
+			continue
+		}
+
+		v := accessor.Get(u)
+		if accessor.Type == "list" || accessor.Type == "keyword" {
+			for _, val := range v.List {
+				rows = append(rows, newSQLRow(true, key, val))
+			}
+			continue
+		}
+
+		if !v.Found {
+			continue
+		}
+		if accessor.Split != nil {
+			for _, val := range accessor.Split(v.Text) {
+				rows = append(rows, newSQLRow(true, key, val))
+			}
+		}
+		row := newSQLRow(false, key, v.Text)
+		row.Boolean = v.Boolean
+		switch accessor.Type {
+		case "number":
+			row.HasNumber, row.Number = true, v.Number
+		case "datetime":
+			row.HasDatetime, row.Datetime = true, v.Datetime
+		case "text":
+			row.Number, row.HasNumber = parseNumberText(v.Text)
+			row.Datetime, row.HasDatetime = parseDatetimeText(v.Text, loc)
+		}
+		if row.HasDatetime {
+			t := time.Unix(row.Datetime/1000, 0).In(loc)
+			row.LocalYear, row.LocalMonth, row.LocalDay = t.Year(), int(t.Month()), t.Day()
+			row.LocalWeekday, row.LocalMinute = int(t.Weekday()), t.Hour()*60+t.Minute()
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// newSQLRow returns the row of key holding str, folded the way text
+// conditions fold values for each combination of case and accent
+// sensitivity
+func newSQLRow(list bool, key, str string) SQLRow {
+	lower := strings.ToLower(str)
+	return SQLRow{
+		List:       list,
+		Key:        key,
+		TextRaw:    str,
+		Text:       strings.TrimSpace(str),
+		TextLower:  strings.TrimSpace(lower),
+		TextASCII:  strings.TrimSpace(ascii.Convert(str)),
+		TextFolded: strings.TrimSpace(ascii.Convert(lower)),
+	}
+}
+
+// SQLFunctions are the functions called by the expressions of ToSQLAt for
+// the transforms and text ops SQL has no equivalent for, by name. Each takes
+// a value and the JSON of the condition to apply:
+//
+//	userutil_text(text, cond) text: the value normalized by cond
+//	userutil_text_match(text, cond) boolean: whether the value matches
+//	userutil_float(number, cond) number: the value transformed, NULL for NaN
+//
+// e.g: registered with github.com/mattn/go-sqlite3
+//
+//	sql.Register("sqlite3_userutil", &sqlite3.SQLiteDriver{
+//		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+//			for name, fn := range userutil.SQLFunctions {
+//				if err := conn.RegisterFunc(name, fn, true); err != nil {
+//					return err
+//				}
+//			}
+//			return nil
+//		},
+//	})
+//
+// Postgres cannot run Go, ToSQLAt returns the conditions calling them as error
+// under DialectPostgres
+var SQLFunctions = map[string]any{
+	"userutil_text":       sqlText,
+	"userutil_text_match": sqlTextMatch,
+	"userutil_float":      sqlFloat,
+}
+
+// SQLSpecCacheSize is the maximum number of conditions decoded by
+// SQLFunctions kept in memory
+const SQLSpecCacheSize = 1024
+
+var sqlSpecs = &sqlSpecCache{m: map[string]any{}}
+
+// sqlSpecCache shares the decoded conditions of SQLFunctions across rows, by
+// JSON, as *textMatcher or []*header.FloatTransform. When full the oldest
+// condition is evicted first
+type sqlSpecCache struct {
+	lock sync.Mutex
+	m    map[string]any
+	keys []string
+}
+
+func (c *sqlSpecCache) get(spec string, decode func(spec string) (any, error)) (any, error) {
+	c.lock.Lock()
+	v, has := c.m[spec]
+	c.lock.Unlock()
+	if has {
+		return v, nil
+	}
+
+	v, err := decode(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, has := c.m[spec]; has {
+		return v, nil
+	}
+	if len(c.keys) >= SQLSpecCacheSize {
+		delete(c.m, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.m[spec] = v
+	c.keys = append(c.keys, spec)
+	return v, nil
+}
+
+func sqlTextMatcher(spec string) (*textMatcher, error) {
+	m, err := sqlSpecs.get(spec, func(spec string) (any, error) {
+		cond := &header.TextCondition{}
+		if err := json.Unmarshal([]byte(spec), cond); err != nil {
+			return nil, err
+		}
+		m, err := newTextMatcher(cond)
+		if err != nil {
+			return nil, err
+		}
+		m.index()
+		return m, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.(*textMatcher), nil
+}
+
+func sqlText(value, spec string) (string, error) {
+	m, err := sqlTextMatcher(spec)
+	if err != nil {
+		return "", err
+	}
+	return m.normalize(value), nil
+}
+
+func sqlTextMatch(value, spec string) (bool, error) {
+	m, err := sqlTextMatcher(spec)
+	if err != nil {
+		return false, err
+	}
+	return m.test(true, m.normalize(value)), nil
+}
+
+// sqlFloat takes any value since SQL passes NULL for NaN
+func sqlFloat(value any, spec string) (any, error) {
+	transforms, err := sqlSpecs.get(spec, func(spec string) (any, error) {
+		cond := &header.FloatCondition{}
+		if err := json.Unmarshal([]byte(spec), cond); err != nil {
+			return nil, err
+		}
+		return cond.GetTransforms(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fl := math.NaN()
+	switch v := value.(type) {
+	case float64:
+		fl = v
+	case int64:
+		fl = float64(v)
+	}
+	fl = applyFloatTransform(fl, transforms.([]*header.FloatTransform))
+	if math.IsNaN(fl) {
+		return nil, nil
+	}
+	return fl, nil
+}
+
+const (
+	sqlTrue  = "1=1"
+	sqlFalse = "1=0"
+)
+
+func sqlBool(b bool) string {
+	if b {
+		return sqlTrue
+	}
+	return sqlFalse
+}
+
+type sqlBuilder struct {
+	ctx     *EvalContext
+	acc     *apb.Account
+	defM    map[string]*header.AttributeDefinition
+	dialect string
+	args    []any
+
+	// noAccount rejects the ops depending on the account, see ToSQL
+	noAccount bool
+
+	// err is the first condition the dialect cannot translate, see udf
+	err error
+}
+
+// udf returns name, a function of SQLFunctions called for what. Postgres
+// cannot register them, the condition is then returned as error
+func (b *sqlBuilder) udf(name, what string) string {
+	if b.dialect == DialectPostgres && b.err == nil {
+		b.err = fmt.Errorf("%s has no postgres translation, it requires %s of SQLFunctions", what, name)
+	}
+	return name
+}
+
+// arg binds v and returns its placeholder, placeholders are numbered as
+// predicates are built before the clause embedding them
+func (b *sqlBuilder) arg(v any) string {
+	b.args = append(b.args, v)
+	if b.dialect == DialectPostgres {
+		return "$" + strconv.Itoa(len(b.args))
+	}
+	return "?" + strconv.Itoa(len(b.args))
+}
+
+func (b *sqlBuilder) node(cond *header.UserViewCondition) (string, error) {
+	if cond.GetKey() == NotKey {
+		inner, err := b.node(negated(cond))
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + inner + ")", nil
+	}
+
+	children, sep := cond.GetOne(), " OR "
+	if len(children) == 0 {
+		children, sep = cond.GetAll(), " AND "
+	}
+	if len(children) > 0 {
+		parts := make([]string, 0, len(children))
+		for _, c := range children {
+			part, err := b.node(c)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		return "(" + strings.Join(parts, sep) + ")", nil
+	}
+	return b.leaf(cond)
+}
+
+func (b *sqlBuilder) leaf(cond *header.UserViewCondition) (string, error) {
+	if field, _ := compareOp(cond); field != "" {
+		return b.compare(cond)
+	}
+
+	key := cond.GetKey()
+	resolver := lookupKey(key)
+	if resolver == nil {
+		return sqlTrue, nil
+	}
+	accessor, err := resolver(key, b.defM)
+	if err != nil {
+		// e.g: def not found
+		return sqlFalse, nil
+	}
+	key = attrColon(key)
+
+	switch accessor.Type {
+	case "keyword":
+		keyword, has := keywordOperand(cond)
+		if !has {
+			return sqlTrue, nil
+		}
+		return "EXISTS (SELECT 1 FROM user_list_values v WHERE v.user_id = u.id AND v.key = " + b.arg(key) +
+			" AND " + b.contains("v.text_raw", keyword) + ")", nil
+	case "list":
+		m, err := newTextMatcher(cond.GetText())
+		if err != nil {
+			return "", err
+		}
+		if accessor.AnyValue && m.quantifier == "" && !setTextOps[m.op] {
+			return b.anyValue(m, key), nil
+		}
+		return b.list(m, "user_list_values", key), nil
+	case "text":
+		if cond.GetText() == nil && cond.GetNumber() != nil {
+			// text holding numbers, e.g: imported order_count
+			pred := b.number(cond.GetNumber(), "a.number")
+			return b.attribute(key, "a.has_number <> 0", pred, EvaluateFloat(false, 0, cond.GetNumber())), nil
+		}
+		if cond.GetText() == nil && cond.GetDatetime() != nil {
+			// text holding dates
+			pred, err := b.datetime(cond.GetDatetime())
+			if err != nil {
+				return "", err
+			}
+			return b.attribute(key, "a.has_datetime <> 0", pred, EvaluateDatetimeAt(b.ctx, b.acc, false, 0, cond.GetDatetime())), nil
+		}
+
+		m, err := newTextMatcher(cond.GetText())
+		if err != nil {
+			return "", err
+		}
+		if m.quantifier != "" || setTextOps[m.op] {
+			if accessor.Split != nil {
+				return b.list(m, "user_list_values", key), nil
+			}
+			// a single value is quantified as a list of zero or one value
+			return b.list(m, "user_attributes", key), nil
+		}
+		pred := b.text(m, "a", textOperands(m.cond, textOperandField(m.op)))
+		return b.attribute(key, sqlTrue, pred, m.match(false, "")), nil
+	case "number":
+		pred := b.number(cond.GetNumber(), "a.number")
+		return b.attribute(key, sqlTrue, pred, EvaluateFloat(false, 0, cond.GetNumber())), nil
+	case "boolean":
+		pred := sqlTrue
+		switch cond.GetBoolean().GetOp() {
+		case "true":
+			pred = "a.boolean <> 0"
+		case "false":
+			pred = "a.boolean = 0"
+		}
+		return b.attribute(key, sqlTrue, pred, EvaluateBool(false, false, cond.GetBoolean())), nil
+	case "datetime":
+		pred, err := b.datetime(cond.GetDatetime())
+		if err != nil {
+			return "", err
+		}
+		return b.attribute(key, sqlTrue, pred, EvaluateDatetimeAt(b.ctx, b.acc, false, 0, cond.GetDatetime())), nil
+	}
+	return sqlTrue, nil
+}
+
+// attribute matches users whose attribute row is present and satisfies
+// pred, or who have no present row when missing is set
+func (b *sqlBuilder) attribute(key, present, pred string, missing bool) string {
+	found := "EXISTS (SELECT 1 FROM user_attributes a WHERE a.user_id = u.id AND a.key = " + b.arg(key) +
+		" AND " + present + " AND " + pred + ")"
+	if !missing {
+		return found
+	}
+	return "(" + found + " OR NOT EXISTS (SELECT 1 FROM user_attributes a WHERE a.user_id = u.id AND a.key = " + b.arg(key) +
+		" AND " + present + "))"
+}
+
+// sqlTextColumn returns the column folded like the values of cond, the
+// folded columns are already trimmed. Transforms other than trim and
+// lower_case have no column
+func sqlTextColumn(cond *header.TextCondition) (string, bool) {
+	caseSensitive := cond.GetCaseSensitive()
+	for _, transform := range cond.GetTransforms() {
+		switch transform.GetName() {
+		case "trim":
+		case "lower_case":
+			caseSensitive = false
+		default:
+			return "", false
+		}
+	}
+
+	switch {
+	case caseSensitive && cond.GetAccentSensitive():
+		return "text", true
+	case cond.GetAccentSensitive():
+		return "text_lower", true
+	case caseSensitive:
+		return "text_ascii", true
+	}
+	return "text_folded", true
+}
+
+// textTransformNames returns the names of the transforms of cond, e.g:
+// trim, normalize_phone
+func textTransformNames(cond *header.TextCondition) string {
+	names := make([]string, 0, len(cond.GetTransforms()))
+	for _, transform := range cond.GetTransforms() {
+		names = append(names, transform.GetName())
+	}
+	return strings.Join(names, ", ")
+}
+
+// textValue returns the values of the rows aliased alias normalized like
+// textMatcher.normalize
+func (b *sqlBuilder) textValue(cond *header.TextCondition, alias string) string {
+	if col, ok := sqlTextColumn(cond); ok {
+		return alias + "." + col
+	}
+	return b.udf("userutil_text", "text transforms "+textTransformNames(cond)) + "(" + alias + ".text_raw, " + b.textSpec(cond, "any", nil) + ")"
+}
+
+// textSpec binds the JSON of cond with op and, as operands of op, the raw
+// operands, for SQLFunctions
+func (b *sqlBuilder) textSpec(cond *header.TextCondition, op string, operands []string) string {
+	spec := &header.TextCondition{
+		Op:              op,
+		Regex:           cond.GetRegex(),
+		CaseSensitive:   cond.GetCaseSensitive(),
+		AccentSensitive: cond.GetAccentSensitive(),
+		Transforms:      cond.GetTransforms(),
+	}
+	name, _ := splitOp(op)
+	switch textOperandField(name) {
+	case "eq":
+		spec.Eq = operands
+	case "neq":
+		spec.Neq = operands
+	case "start_with":
+		spec.StartWith = operands
+	case "end_with":
+		spec.EndWith = operands
+	case "contain":
+		spec.Contain = operands
+	case "not_contain":
+		spec.NotContain = operands
+	case "not_start_with":
+		spec.NotStartWith = operands
+	}
+	data, _ := json.Marshal(spec)
+	return b.arg(string(data))
+}
+
+func (b *sqlBuilder) in(col string, vals []string) string {
+	placeholders := make([]string, 0, len(vals))
+	for _, val := range vals {
+		placeholders = append(placeholders, b.arg(val))
+	}
+	return col + " IN (" + strings.Join(placeholders, ", ") + ")"
+}
+
+// inInts is in for integers, false without value
+func (b *sqlBuilder) inInts(col string, vals []int) string {
+	if len(vals) == 0 {
+		return sqlFalse
+	}
+	placeholders := make([]string, 0, len(vals))
+	for _, val := range vals {
+		placeholders = append(placeholders, b.arg(val))
+	}
+	return col + " IN (" + strings.Join(placeholders, ", ") + ")"
+}
+
+func (b *sqlBuilder) contains(col, cs string) string {
+	if b.dialect == DialectPostgres {
+		return "strpos(" + col + ", " + b.arg(cs) + ") > 0"
+	}
+	return "instr(" + col + ", " + b.arg(cs) + ") > 0"
+}
+
+// anyOperand joins pred of each operand with OR, false without operand
+func anyOperand(operands []string, pred func(cs string) string) string {
+	if len(operands) == 0 {
+		return sqlFalse
+	}
+	parts := make([]string, 0, len(operands))
+	for _, cs := range operands {
+		parts = append(parts, pred(cs))
+	}
+	return "(" + strings.Join(parts, " OR ") + ")"
+}
+
+// text returns the predicate of a single value in the rows aliased alias, as
+// tested by textMatcher.test. operands are the raw operands of m, passed to
+// SQLFunctions for the ops SQL has no equivalent for
+func (b *sqlBuilder) text(m *textMatcher, alias string, operands []string) string {
+	switch m.op {
+	case "any", "has_value":
+		return sqlTrue
+	case "regex", "edit_distance", "similarity", "sounds_like",
+		"contain_word", "not_contain_word", "wildcard", "not_wildcard":
+		_, _, op, _ := splitQuantifier(m.cond.GetOp())
+		return b.udf("userutil_text_match", "text op "+strconv.Quote(m.op)) + "(" + alias + ".text_raw, " + b.textSpec(m.cond, op, operands) + ")"
+	}
+	if !hasOp(textOps, m.op) {
+		return sqlTrue
+	}
+
+	col := b.textValue(m.cond, alias)
+	prefix := func(cs string) string {
+		return "substr(" + col + ", 1, " + strconv.Itoa(utf8.RuneCountInString(cs)) + ") = " + b.arg(cs)
+	}
+	suffix := func(cs string) string {
+		n := strconv.Itoa(utf8.RuneCountInString(cs))
+		return "(length(" + col + ") >= " + n + " AND substr(" + col + ", length(" + col + ") - " + n + " + 1) = " + b.arg(cs) + ")"
+	}
+	contain := func(cs string) string { return b.contains(col, cs) }
+
+	switch m.op {
+	case "is_empty":
+		return col + " = ''"
+	case "eq", "neq", "in_set", "not_in_set":
+		if len(m.operands) == 0 {
+			return sqlBool(m.op != "in_set")
+		}
+		if m.op == "neq" || m.op == "not_in_set" {
+			return "NOT " + b.in(col, m.operands)
+		}
+		return b.in(col, m.operands)
+	case "start_with":
+		return anyOperand(m.operands, prefix)
+	case "end_with":
+		return anyOperand(m.operands, suffix)
+	case "contain":
+		return anyOperand(m.operands, contain)
+	case "not_start_with":
+		return "NOT " + anyOperand(m.operands, prefix)
+	case "not_end_with":
+		return "NOT " + anyOperand(m.operands, suffix)
+	case "not_contain":
+		return "NOT " + anyOperand(m.operands, contain)
+	case "length_eq":
+		return "length(" + col + ") = " + b.arg(m.length)
+	case "length_gt":
+		return "length(" + col + ") > " + b.arg(m.length)
+	case "length_lt":
+		return "length(" + col + ") < " + b.arg(m.length)
+	}
+	return sqlTrue
+}
+
+// list returns the predicate of the values of key in table, as evaluated by
+// textMatcher.matchAll
+func (b *sqlBuilder) list(m *textMatcher, table, key string) string {
+	exists := func(pred string) string {
+		return "EXISTS (SELECT 1 FROM " + table + " v WHERE v.user_id = u.id AND v.key = " + b.arg(key) + " AND " + pred + ")"
+	}
+	count := func(pred string) string {
+		return "(SELECT COUNT(*) FROM " + table + " v WHERE v.user_id = u.id AND v.key = " + b.arg(key) + " AND " + pred + ")"
+	}
+
+	if setTextOps[m.op] {
+		switch m.op {
+		case "contains_any", "contains_none":
+			pred := sqlFalse
+			if len(m.operands) > 0 {
+				pred = exists(b.in(b.textValue(m.cond, "v"), m.operands))
+			}
+			if m.op == "contains_none" {
+				return "NOT " + pred
+			}
+			return pred
+		case "contains_all", "subset_of", "equals_set":
+			var parts []string
+			if m.op != "contains_all" {
+				notIn := sqlTrue
+				if len(m.operands) > 0 {
+					notIn = "NOT " + b.in(b.textValue(m.cond, "v"), m.operands)
+				}
+				parts = append(parts, "NOT "+exists(notIn))
+			}
+			if m.op != "subset_of" {
+				distinct := map[string]bool{}
+				for _, cs := range m.operands {
+					if !distinct[cs] {
+						distinct[cs] = true
+						parts = append(parts, exists(b.textValue(m.cond, "v")+" = "+b.arg(cs)))
+					}
+				}
+			}
+			if len(parts) == 0 {
+				return sqlTrue
+			}
+			return "(" + strings.Join(parts, " AND ") + ")"
+		case "size_eq":
+			return count(sqlTrue) + " = " + b.arg(m.length)
+		case "size_gt":
+			return count(sqlTrue) + " > " + b.arg(m.length)
+		case "size_lt":
+			return count(sqlTrue) + " < " + b.arg(m.length)
+		}
+	}
+
+	operands := textOperands(m.cond, textOperandField(m.op))
+	switch m.quantifier {
+	case "any":
+		return exists(b.text(m, "v", operands))
+	case "none":
+		return "NOT " + exists(b.text(m, "v", operands))
+	case "all":
+		if len(m.each) > 0 {
+			parts := make([]string, 0, len(m.each))
+			for i, each := range m.each {
+				parts = append(parts, exists(b.text(each, "v", operands[i:i+1])))
+			}
+			return "(" + strings.Join(parts, " AND ") + ")"
+		}
+		return "(" + exists(sqlTrue) + " AND NOT " + exists("NOT ("+b.text(m, "v", operands)+")") + ")"
+	case "exactly":
+		return count(b.text(m, "v", operands)) + " = " + b.arg(m.count)
+	case "at_least":
+		return count(b.text(m, "v", operands)) + " >= " + b.arg(m.count)
+	}
+
+	switch m.op {
+	case "has_value":
+		return exists(sqlTrue)
+	case "is_empty":
+		return "NOT " + exists(sqlTrue)
+	case "eq", "neq":
+		if len(m.operands) == 0 {
+			return sqlTrue
+		}
+	}
+	if !hasOp(textOps, m.op) || m.op == "any" {
+		return sqlTrue
+	}
+	if negatedTextOps[m.op] {
+		return "NOT " + exists("NOT ("+b.text(m, "v", operands)+")")
+	}
+	return exists(b.text(m, "v", operands))
+}
+
+// anyValue returns the predicate of the values of key, as evaluated by
+// textMatcher.matchAny
+func (b *sqlBuilder) anyValue(m *textMatcher, key string) string {
+	pred := b.text(m, "v", textOperands(m.cond, textOperandField(m.op)))
+	found := "EXISTS (SELECT 1 FROM user_list_values v WHERE v.user_id = u.id AND v.key = " + b.arg(key) + " AND " + pred + ")"
+	if !m.test(false, m.normalize("")) {
+		return found
+	}
+	return "(" + found + " OR NOT EXISTS (SELECT 1 FROM user_list_values v WHERE v.user_id = u.id AND v.key = " + b.arg(key) + "))"
+}
+
+// numberExpr applies the number transforms of cond to col, through
+// userutil_float when one has no SQL equivalent. NaN is NULL
+func (b *sqlBuilder) numberExpr(cond *header.FloatCondition, col string) string {
+	expr := col
+	for _, transform := range cond.GetTransforms() {
+		name, args := splitOp(transform.GetName())
+		nums, _ := floatArgs(args)
+		switch name {
+		case "abs":
+			expr = "ABS(" + expr + ")"
+		case "multiply":
+			if len(nums) == 1 {
+				expr = "(" + expr + " * " + b.arg(nums[0]) + ")"
+			}
+		case "divide":
+			if len(nums) == 1 && nums[0] != 0 {
+				expr = "(" + expr + " / " + b.arg(nums[0]) + ")"
+			}
+		case "clamp":
+			if len(nums) == 2 {
+				if b.dialect == DialectPostgres {
+					expr = "GREATEST(" + b.arg(nums[0]) + ", LEAST(" + b.arg(nums[1]) + ", " + expr + "))"
+				} else {
+					expr = "MAX(" + b.arg(nums[0]) + ", MIN(" + b.arg(nums[1]) + ", " + expr + "))"
+				}
+			}
+		default:
+			data, _ := json.Marshal(&header.FloatCondition{Transforms: cond.GetTransforms()})
+			return b.udf("userutil_float", "number transform "+strconv.Quote(name)) + "(" + col + ", " + b.arg(string(data)) + ")"
+		}
+	}
+	return expr
+}
+
+// number returns the predicate of a number in col, as evaluated by
+// EvaluateFloat
+func (b *sqlBuilder) number(cond *header.FloatCondition, col string) string {
+	x := b.numberExpr(cond, col)
+	near := func(f float64) string { return "ABS(" + x + " - " + b.arg(f) + ") < " + b.arg(Tolerance) }
+
+	pred := sqlTrue
+	switch cond.GetOp() {
+	case "has_value":
+		pred = sqlBool(cond.GetHasValue())
+	case "is_empty":
+		pred = sqlFalse
+	case "eq", "neq":
+		operands := cond.GetEq()
+		if cond.GetOp() == "neq" {
+			operands = cond.GetNeq()
+		}
+		if len(operands) > 0 {
+			parts := make([]string, 0, len(operands))
+			for _, f := range operands {
+				parts = append(parts, near(f))
+			}
+			pred = "(" + strings.Join(parts, " OR ") + ")"
+			if cond.GetOp() == "neq" {
+				pred = "NOT " + pred
+			}
+		}
+	case "gt":
+		pred = x + " > " + b.arg(cond.GetGt())
+	case "lt":
+		// the lt and gte quirks of EvaluateFloat are kept deliberately
+		pred = x + " <= " + b.arg(cond.GetLt())
+	case "gte":
+		pred = "(" + x + " >= " + b.arg(cond.GetLte()) + " OR " + near(cond.GetGte()) + ")"
+	case "lte":
+		pred = "(" + x + " <= " + b.arg(cond.GetLte()) + " OR " + near(cond.GetLte()) + ")"
+	case "in_range":
+		pred = sqlFalse
+		if len(cond.GetInRange()) >= 2 {
+			pred = "(" + b.arg(cond.GetInRange()[0]) + " <= " + x + " AND " + x + " <= " + b.arg(cond.GetInRange()[1]) + ")"
+		}
+	case "not_in_range":
+		pred = sqlFalse
+		if len(cond.GetNotInRange()) >= 2 {
+			pred = "(" + x + " <= " + b.arg(cond.GetNotInRange()[0]) + " OR " + b.arg(cond.GetNotInRange()[1]) + " <= " + x + ")"
+		}
+	}
+
+	// NaN, NULL in SQL, compares as in Go
+	if EvaluateFloat(true, math.NaN(), cond) {
+		return "(" + x + " IS NULL OR " + pred + ")"
+	}
+	return "(" + x + " IS NOT NULL AND " + pred + ")"
+}
+
+// accountDatetimeOps depend on the account timezone, week and fiscal year
+// settings or business hours
+var accountDatetimeOps = map[string]bool{
+	"in_business_hour": true, "non_business_hour": true, "business_hours_last": true, "business_hours_before_ago": true,
+	"today": true, "yesterday": true, "tomorrow": true,
+	"this_week": true, "last_week": true, "next_week": true, "this_month": true, "last_month": true, "next_month": true,
+	"this_quarter": true, "last_quarter": true, "this_year": true, "last_year": true,
+	"this_fiscal_quarter": true, "last_fiscal_quarter": true, "this_fiscal_year": true, "last_fiscal_year": true,
+	"anniversary_today": true, "anniversary_in_next": true, "month_is": true, "day_of_month_is": true,
+	"days_of_week": true, "time_of_day": true,
+}
+
+// datetime returns the predicate of the date in the rows aliased a, as
+// evaluated by EvaluateDatetimeAt. Periods are computed now, in the timezone
+// of the context
+func (b *sqlBuilder) datetime(cond *header.DatetimeCondition) (string, error) {
+	op, args := splitOp(cond.GetOp())
+	if b.noAccount && accountDatetimeOps[op] {
+		return "", fmt.Errorf("datetime op %q depends on the account, use ToSQLAt", op)
+	}
+
+	loc := b.ctx.location(b.acc)
+	now := b.ctx.now().In(loc)
+	nowsec := now.Unix()
+
+	sec := "(a.datetime / 1000)"
+	period := func(start, end time.Time) string {
+		return "(" + sec + " >= " + b.arg(start.Unix()) + " AND " + sec + " < " + b.arg(end.Unix()) + ")"
+	}
+	closed := func(from, to int64) string {
+		return "(" + sec + " >= " + b.arg(from) + " AND " + sec + " <= " + b.arg(to) + ")"
+	}
+
+	switch op {
+	case "any", "has_value":
+		return sqlTrue, nil
+	case "unset":
+		return sqlFalse, nil
+	case "in_business_hour":
+		return b.businessHours(), nil
+	case "non_business_hour":
+		return "NOT " + b.businessHours(), nil
+	case "time_of_day":
+		if len(args) != 2 {
+			return sqlFalse, nil
+		}
+		from, ok1 := parseClock(args[0])
+		to, ok2 := parseClock(args[1])
+		if !ok1 || !ok2 {
+			return sqlFalse, nil
+		}
+		if from <= to {
+			return "(a.local_minute >= " + b.arg(from) + " AND a.local_minute <= " + b.arg(to) + ")", nil
+		}
+		// window crosses midnight, e.g: 22:00 to 06:00
+		return "(a.local_minute >= " + b.arg(from) + " OR a.local_minute <= " + b.arg(to) + ")", nil
+	case "business_hours_last", "business_hours_before_ago":
+		limit, ok := intArg(args)
+		if !ok {
+			return sqlFalse, nil
+		}
+		if limit < 0 {
+			// every count is above a negative limit
+			if op == "business_hours_last" {
+				return sqlFalse, nil
+			}
+			return sec + " <= " + b.arg(nowsec), nil
+		}
+		cutoff, bounded := businessCutoff(b.acc.GetBusinessHours(), loc, now, limit)
+		if op == "business_hours_before_ago" {
+			if !bounded {
+				return sqlFalse, nil
+			}
+			return sec + " < " + b.arg(cutoff), nil
+		}
+		if !bounded {
+			return sec + " <= " + b.arg(nowsec), nil
+		}
+		return closed(cutoff, nowsec), nil
+	case "today":
+		start := startOfDay(now)
+		return period(start, start.AddDate(0, 0, 1)), nil
+	case "yesterday":
+		end := startOfDay(now)
+		return period(end.AddDate(0, 0, -1), end), nil
+	case "tomorrow":
+		start := startOfDay(now).AddDate(0, 0, 1)
+		return period(start, start.AddDate(0, 0, 1)), nil
+	case "this_week", "last_week", "next_week":
+		start := startOfWeek(now, b.ctx.weekStart())
+		if op == "last_week" {
+			start = start.AddDate(0, 0, -7)
+		} else if op == "next_week" {
+			start = start.AddDate(0, 0, 7)
+		}
+		return period(start, start.AddDate(0, 0, 7)), nil
+	case "this_month", "last_month", "next_month":
+		start := startOfMonth(now)
+		if op == "last_month" {
+			start = start.AddDate(0, -1, 0)
+		} else if op == "next_month" {
+			start = start.AddDate(0, 1, 0)
+		}
+		return period(start, start.AddDate(0, 1, 0)), nil
+	case "this_quarter", "last_quarter", "this_fiscal_quarter", "last_fiscal_quarter":
+		yearstart := time.January
+		if strings.Contains(op, "fiscal") {
+			yearstart = b.ctx.fiscalYearStart()
+		}
+		start := startOfQuarter(now, yearstart)
+		if strings.HasPrefix(op, "last_") {
+			start = start.AddDate(0, -3, 0)
+		}
+		return period(start, start.AddDate(0, 3, 0)), nil
+	case "this_year", "last_year", "this_fiscal_year", "last_fiscal_year":
+		yearstart := time.January
+		if strings.Contains(op, "fiscal") {
+			yearstart = b.ctx.fiscalYearStart()
+		}
+		start := startOfYear(now, yearstart)
+		if strings.HasPrefix(op, "last_") {
+			start = start.AddDate(-1, 0, 0)
+		}
+		return period(start, start.AddDate(1, 0, 0)), nil
+	case "date_last_30mins":
+		return closed(nowsec-1800, nowsec), nil
+	case "date_last_2hours":
+		return closed(nowsec-7200, nowsec), nil
+	case "date_last_24h":
+		return closed(nowsec-86400, nowsec), nil
+	case "date_last_7days":
+		return closed(nowsec-7*86400, nowsec), nil
+	case "date_last_30days":
+		return closed(nowsec-30*86400, nowsec), nil
+	case "next":
+		n, ok := intArg(args)
+		if !ok {
+			return sqlFalse, nil
+		}
+		return closed(nowsec, nowsec+n), nil
+	case "after_from_now":
+		n, ok := intArg(args)
+		if !ok {
+			return sqlFalse, nil
+		}
+		return sec + " > " + b.arg(nowsec+n), nil
+	case "last":
+		return closed(nowsec-cond.GetLast(), nowsec), nil
+	case "before_ago":
+		return sec + " < " + b.arg(nowsec-cond.GetBeforeAgo()), nil
+	case "anniversary_today":
+		return b.inInts("(a.local_month * 100 + a.local_day)", anniversaryDays(now, 0)), nil
+	case "anniversary_in_next":
+		days, ok := intArg(args)
+		if !ok {
+			return sqlFalse, nil
+		}
+		return b.inInts("(a.local_month * 100 + a.local_day)", anniversaryDays(now, days)), nil
+	case "month_is":
+		var months []int
+		for _, arg := range args {
+			if month, ok := parseMonth(arg); ok {
+				months = append(months, int(month))
+			}
+		}
+		return b.inInts("a.local_month", months), nil
+	case "day_of_month_is":
+		var days []int
+		for _, arg := range args {
+			if day, err := strconv.Atoi(strings.TrimSpace(arg)); err == nil {
+				days = append(days, day)
+			}
+		}
+		return b.inInts("a.local_day", days), nil
+	case "days_of_week":
+		var weekdays []int
+		for _, weekday := range cond.GetDaysOfWeek() {
+			for d := time.Sunday; d <= time.Saturday; d++ {
+				if strings.EqualFold(weekday, d.String()) {
+					weekdays = append(weekdays, int(d))
+				}
+			}
+		}
+		return b.inInts("a.local_weekday", weekdays), nil
+	case "after":
+		return sec + " >= " + b.arg(cond.GetAfter()/1000), nil
+	case "before":
+		return sec + " <= " + b.arg(cond.GetBefore()/1000), nil
+	case "between":
+		if len(cond.GetBetween()) != 2 {
+			return sqlTrue, nil
+		}
+		return closed(cond.GetBetween()[0]/1000, cond.GetBetween()[1]/1000), nil
+	case "outside":
+		if len(cond.GetOutside()) != 2 {
+			return sqlTrue, nil
+		}
+		return "(" + sec + " <= " + b.arg(cond.GetOutside()[0]/1000) + " OR " + sec + " >= " + b.arg(cond.GetOutside()[1]/1000) + ")", nil
+	}
+	return sqlTrue, nil
+}
+
+// businessHours returns the predicate of the local date in the rows aliased
+// a being in the business hours of the account, as evaluated by
+// business_hours.DuringBusinessHour: never on holidays, always without
+// working days, else within a working day of the weekday, giving up at the
+// first working day of the weekday with an invalid time
+func (b *sqlBuilder) businessHours() string {
+	bh := b.acc.GetBusinessHours()
+	var holidays []string
+	for _, h := range bh.GetHolidays() {
+		holidays = append(holidays, "(a.local_year = "+b.arg(h.GetYear())+" AND a.local_month = "+b.arg(h.GetMonth())+
+			" AND a.local_day = "+b.arg(h.GetDay())+")")
+	}
+	working := sqlTrue
+	if len(bh.GetWorkingDays()) > 0 {
+		var cases []string
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			var ranges []string
+			for _, wd := range bh.GetWorkingDays() {
+				if wd.GetWeekday() != d.String() && wd.GetWeekday() != "Everyday" {
+					continue
+				}
+				start, ok1 := businessMinute(wd.GetStartTime())
+				end, ok2 := businessMinute(wd.GetEndTime())
+				if !ok1 || !ok2 {
+					break
+				}
+				ranges = append(ranges, "(a.local_minute >= "+b.arg(start)+" AND a.local_minute <= "+b.arg(end)+")")
+			}
+			if len(ranges) > 0 {
+				cases = append(cases, " WHEN "+b.arg(int(d))+" THEN ("+strings.Join(ranges, " OR ")+")")
+			}
+		}
+		working = sqlFalse
+		if len(cases) > 0 {
+			working = "CASE a.local_weekday" + strings.Join(cases, "") + " ELSE " + sqlFalse + " END"
+		}
+	}
+
+	if len(holidays) == 0 {
+		return "(" + working + ")"
+	}
+	return "(NOT (" + strings.Join(holidays, " OR ") + ") AND " + working + ")"
+}
+
+// businessMinute converts a working day time, e.g: 10:25, or a number of
+// minutes to minutes since midnight, as business_hours does
+func businessMinute(s string) (int, bool) {
+	hours, mins := 0, 0
+	parts := strings.SplitN(s, ":", 2)
+	var err error
+	if len(parts) == 2 {
+		if hours, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, false
+		}
+		mins, err = strconv.Atoi(parts[1])
+	} else {
+		mins, err = strconv.Atoi(parts[0])
+	}
+	if err != nil || mins > 59 || mins < 0 || hours > 23 || hours < 0 {
+		return 0, false
+	}
+	return hours*60 + mins, true
+}
+
+// businessCutoffSlack is the time searched before now beside limit, for the
+// nights, weekends and holidays the business seconds skip
+const businessCutoffSlack = 4 * 7 * 86400
+
+// businessCutoff returns the earliest second from which at most limit
+// business seconds elapse until now, as counted by businessSeconds, which
+// only grows as the second moves back. Business seconds never outpace
+// seconds, the search starts limit and businessCutoffSlack before now and
+// widens while the count stays within limit. bounded is false when it does
+// back to year 1
+func businessCutoff(bh *apb.BusinessHours, loc *time.Location, now time.Time, limit int64) (int64, bool) {
+	within := func(sec int64) bool {
+		return businessSeconds(bh, time.Unix(sec, 0).In(loc), now, limit) <= limit
+	}
+
+	first := time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC).Unix()
+	hi := now.Unix()
+	lo := first
+	if limit < hi-first-businessCutoffSlack {
+		lo = hi - limit - businessCutoffSlack
+	}
+	for within(lo) {
+		if lo == first {
+			return lo, false
+		}
+		lo, hi = lo-2*(hi-lo), lo
+		if lo < first {
+			lo = first
+		}
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if within(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, true
+}
+
+// anniversaryDays returns the days, as month*100+day, whose anniversary is
+// within days from now, see anniversary
+func anniversaryDays(now time.Time, days int64) []int {
+	if days > 366 {
+		// every day has an anniversary within a year
+		days = 366
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var out []int
+	for i := 0; int64(i) <= days; i++ {
+		day := today.AddDate(0, 0, i)
+		out = append(out, int(day.Month())*100+day.Day())
+		if day.Month() == time.February && day.Day() == 28 && !isLeap(day.Year()) {
+			out = append(out, 229)
+		}
+	}
+	return out
+}
+
+// compare translates a compare op, see compileCompare
+func (b *sqlBuilder) compare(cond *header.UserViewCondition) (string, error) {
+	if _, err := compileCompare(b.defM, cond); err != nil {
+		return "", err
+	}
+
+	_, op := compareOp(cond)
+	_, args := splitOp(op)
+	cmp, other := strings.TrimSpace(args[0]), strings.TrimSpace(args[1])
+	left, _ := ResolveKey(cond.GetKey(), b.defM)
+
+	var l, r string
+	switch left.Type {
+	case "text":
+		l, r = b.textValue(cond.GetText(), "a"), b.textValue(cond.GetText(), "o")
+	case "number":
+		// numbers closer than Tolerance are equal, NaN is neither lower nor
+		// greater, as in compareFloat
+		x, y := b.numberExpr(cond.GetNumber(), "a.number"), b.numberExpr(cond.GetNumber(), "o.number")
+		l, r = "CASE WHEN ABS("+x+" - "+y+") < "+b.arg(Tolerance)+" THEN 0 WHEN "+x+" < "+y+" THEN -1 WHEN "+x+" > "+y+" THEN 1 ELSE 0 END", "0"
+	case "datetime":
+		l, r = "a.datetime", "o.datetime"
+	case "boolean":
+		l, r = "(a.boolean <> 0)", "(o.boolean <> 0)"
+	}
+
+	operators := map[string]string{"eq": "=", "neq": "<>", "lt": "<", "before": "<", "gt": ">", "after": ">", "lte": "<=", "gte": ">="}
+	return "EXISTS (SELECT 1 FROM user_attributes a JOIN user_attributes o ON o.user_id = a.user_id" +
+		" WHERE a.user_id = u.id AND a.key = " + b.arg(attrColon(cond.GetKey())) + " AND o.key = " + b.arg(attrColon(other)) +
+		" AND " + l + " " + operators[cmp] + " " + r + ")", nil
+}
+
+// attrColon normalizes the attr. key prefix to attr:
+func attrColon(key string) string {
+	if strings.HasPrefix(key, "attr.") {
+		return "attr:" + key[5:]
+	}
+	return key
+}
@@ -0,0 +1,209 @@
+package userutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subiz/header"
+	apb "github.com/subiz/header/account"
+	"google.golang.org/protobuf/proto"
+)
+
+var sqlDefM = map[string]*header.AttributeDefinition{
+	"name":      {Key: "name", Type: "text"},
+	"score":     {Key: "score", Type: "number"},
+	"interests": {Key: "interests", Type: "list"},
+	"seen":      {Key: "seen", Type: "datetime"},
+}
+
+func TestToSQLPostgres(t *testing.T) {
+	ctx := &EvalContext{Now: time.Date(2023, 7, 12, 10, 0, 0, 0, time.UTC)}
+	cases := []struct {
+		cond  *header.UserViewCondition
+		query string
+		args  []any
+	}{
+		{
+			&header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "start_with", StartWith: []string{"Thành"}}},
+			"u.deleted = 0 AND EXISTS (SELECT 1 FROM user_attributes a WHERE a.user_id = u.id AND a.key = $2 AND 1=1 AND (substr(a.text_folded, 1, 5) = $1))",
+			[]any{"thanh", "attr:name"},
+		},
+		{
+			&header.UserViewCondition{Key: "attr:score", Number: &header.FloatCondition{Op: "gt", Gt: 10, Transforms: []*header.FloatTransform{{Name: "clamp:0,100"}}}},
+			"u.deleted = 0 AND EXISTS (SELECT 1 FROM user_attributes a WHERE a.user_id = u.id AND a.key = $4 AND 1=1 AND (GREATEST($1, LEAST($2, a.number)) IS NOT NULL AND GREATEST($1, LEAST($2, a.number)) > $3))",
+			[]any{0.0, 100.0, 10.0, "attr:score"},
+		},
+		{
+			&header.UserViewCondition{Key: "attr:interests", Text: &header.TextCondition{Op: "contains_any", Eq: []string{"Golf"}}},
+			"u.deleted = 0 AND EXISTS (SELECT 1 FROM user_list_values v WHERE v.user_id = u.id AND v.key = $2 AND v.text_folded IN ($1))",
+			[]any{"golf", "attr:interests"},
+		},
+		{
+			&header.UserViewCondition{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "today"}},
+			"u.deleted = 0 AND EXISTS (SELECT 1 FROM user_attributes a WHERE a.user_id = u.id AND a.key = $3 AND 1=1 AND ((a.datetime / 1000) >= $1 AND (a.datetime / 1000) < $2))",
+			[]any{int64(1689120000), int64(1689206400), "attr:seen"},
+		},
+		{
+			&header.UserViewCondition{Key: NotKey, Deleted: true, One: []*header.UserViewCondition{{Key: "attr:name", Text: &header.TextCondition{Op: "has_value"}}}},
+			"u.deleted > 0 AND NOT ((EXISTS (SELECT 1 FROM user_attributes a WHERE a.user_id = u.id AND a.key = $1 AND 1=1 AND 1=1)))",
+			[]any{"attr:name"},
+		},
+	}
+
+	for _, c := range cases {
+		query, args, err := ToSQLAt(ctx, nil, sqlDefM, c.cond, DialectPostgres)
+		if err != nil {
+			t.Errorf("%v: %v", c.cond, err)
+			continue
+		}
+		if query != c.query {
+			t.Errorf("%v: got %s, want %s", c.cond, query, c.query)
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%v: got args %#v, want %#v", c.cond, args, c.args)
+		}
+	}
+}
+
+// TestToSQLOps translates every op and transform, Postgres rejects the ones
+// only SQLFunctions implement
+func TestToSQLOps(t *testing.T) {
+	withArgs := map[string]string{
+		"text edit_distance": "edit_distance:1", "text similarity": "similarity:0.5",
+		"text length_eq": "length_eq:3", "text length_gt": "length_gt:3", "text length_lt": "length_lt:3",
+		"text size_eq": "size_eq:1", "text size_gt": "size_gt:1", "text size_lt": "size_lt:1",
+		"text transform normalize_phone": "normalize_phone:e164,84", "text transform substring": "substring:1,3",
+		"text transform split_part": "split_part:-,1",
+		"number transform round":    "round:2", "number transform multiply": "multiply:2",
+		"number transform divide": "divide:10", "number transform clamp": "clamp:0,10",
+		"datetime anniversary_in_next": "anniversary_in_next:7", "datetime month_is": "month_is:jan",
+		"datetime day_of_month_is": "day_of_month_is:1", "datetime next": "next:3600",
+		"datetime after_from_now": "after_from_now:60", "datetime time_of_day": "time_of_day:09:00,17:00",
+		"datetime business_hours_last":       "business_hours_last:3600",
+		"datetime business_hours_before_ago": "business_hours_before_ago:3600",
+	}
+	udfs := map[string]bool{
+		"text regex": true, "text edit_distance": true, "text similarity": true, "text sounds_like": true,
+		"text contain_word": true, "text not_contain_word": true, "text wildcard": true, "text not_wildcard": true,
+		"text transform trim": false, "text transform lower_case": false,
+		"number transform abs": false, "number transform multiply": false,
+		"number transform divide": false, "number transform clamp": false,
+	}
+
+	tables := map[string]map[string]opGrammar{
+		"text": textOps, "number": floatOps, "boolean": boolOps, "datetime": datetimeOps,
+		"text transform": textTransforms, "number transform": floatTransforms,
+	}
+	ctx := &EvalContext{Now: time.Date(2023, 7, 12, 10, 0, 0, 0, time.UTC)}
+	for kind, table := range tables {
+		for name, grammar := range table {
+			op, has := withArgs[kind+" "+name]
+			if grammar.args == "" {
+				op = name
+			} else if !has {
+				t.Errorf("%s %s takes %s, add it to the cases", kind, name, grammar.usage(name))
+				continue
+			}
+
+			cond := grammarLeaf(kind, op)
+			if _, _, err := ToSQLAt(ctx, nil, grammarDefM, cond, DialectSQLite); err != nil {
+				t.Errorf("%s %s: %v", kind, op, err)
+			}
+
+			udf, has := udfs[kind+" "+name]
+			if !has {
+				// transforms have a column or a function in SQL only when listed
+				udf = strings.HasSuffix(kind, "transform")
+			}
+			_, _, err := ToSQLAt(ctx, nil, grammarDefM, cond, DialectPostgres)
+			if udf && (err == nil || !strings.Contains(err.Error(), "no postgres translation")) {
+				t.Errorf("%s %s: want a postgres error, got %v", kind, op, err)
+			}
+			if !udf && err != nil {
+				t.Errorf("%s %s: postgres %v", kind, op, err)
+			}
+		}
+	}
+
+	if _, _, err := ToSQL(sqlDefM, &header.UserViewCondition{Key: "id"}, "mysql"); err == nil {
+		t.Error("want an unsupported dialect error")
+	}
+}
+
+func TestToSQLRejectsAccountOps(t *testing.T) {
+	for _, op := range []string{"today", "this_fiscal_year", "anniversary_in_next:3", "days_of_week", "time_of_day:09:00,17:00",
+		"in_business_hour", "business_hours_last:3600"} {
+		cond := &header.UserViewCondition{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: op}}
+		if _, _, err := ToSQL(sqlDefM, cond, DialectSQLite); err == nil {
+			t.Errorf("%s: want an error", op)
+		}
+		if _, _, err := ToSQLAt(&EvalContext{}, nil, sqlDefM, cond, DialectSQLite); err != nil {
+			t.Errorf("%s: %v", op, err)
+		}
+	}
+
+	cond := &header.UserViewCondition{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "date_last_24h"}}
+	if _, _, err := ToSQL(sqlDefM, cond, DialectSQLite); err != nil {
+		t.Errorf("date_last_24h: %v", err)
+	}
+}
+
+func TestBusinessCutoff(t *testing.T) {
+	now := time.Date(2023, 7, 12, 10, 0, 0, 0, time.UTC)
+	weekdays := &apb.BusinessHours{}
+	for _, day := range []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday"} {
+		weekdays.WorkingDays = append(weekdays.WorkingDays, &apb.BusinessHours_WorkingDay{Weekday: proto.String(day), StartTime: proto.String("09:00"), EndTime: proto.String("16:59")})
+	}
+	// the office closed for 10 weeks before a week ago, past the slack
+	closed := &apb.BusinessHours{WorkingDays: weekdays.WorkingDays}
+	for day := now.AddDate(0, 0, -77); day.Before(now.AddDate(0, 0, -7)); day = day.AddDate(0, 0, 1) {
+		closed.Holidays = append(closed.Holidays, &apb.BusinessHours_Holiday{Year: proto.Int32(int32(day.Year())), Month: proto.Int32(int32(day.Month())), Day: proto.Int32(int32(day.Day()))})
+	}
+
+	cases := []struct {
+		bh    *apb.BusinessHours
+		limit int64
+		want  time.Time
+	}{
+		{nil, 3600, now.Add(-time.Hour)},
+		{nil, 0, now},
+		// 1 hour today, 8 hours each on Tuesday and Monday, none over the
+		// weekend
+		{weekdays, 17 * 3600, time.Date(2023, 7, 7, 17, 0, 0, 0, time.UTC)},
+		{weekdays, 17*3600 + 1, time.Date(2023, 7, 7, 16, 59, 59, 0, time.UTC)},
+		// 5 days of 8 hours since last Wednesday, 1 hour before the holidays
+		{closed, 41 * 3600, time.Date(2023, 4, 25, 17, 0, 0, 0, time.UTC)},
+		{closed, 42 * 3600, time.Date(2023, 4, 25, 16, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		cutoff, bounded := businessCutoff(c.bh, time.UTC, now, c.limit)
+		if !bounded || cutoff != c.want.Unix() {
+			t.Errorf("%d business seconds: got %v, %v, want %v", c.limit, time.Unix(cutoff, 0).UTC(), bounded, c.want)
+		}
+	}
+
+	// no working day has no business second
+	none := &apb.BusinessHours{WorkingDays: []*apb.BusinessHours_WorkingDay{{Weekday: proto.String("Monday"), StartTime: proto.String("x"), EndTime: proto.String("y")}}}
+	if _, bounded := businessCutoff(none, time.UTC, now, 60); bounded {
+		t.Error("want an unbounded cutoff")
+	}
+}
+
+func TestSQLSpecCacheEviction(t *testing.T) {
+	c := &sqlSpecCache{m: map[string]any{}}
+	decode := func(spec string) (any, error) { return spec, nil }
+	for i := 0; i <= SQLSpecCacheSize; i++ {
+		c.get(strings.Repeat("x", i), decode)
+	}
+	if len(c.m) != SQLSpecCacheSize || len(c.keys) != SQLSpecCacheSize {
+		t.Fatalf("want %d conditions, got %d, %d keys", SQLSpecCacheSize, len(c.m), len(c.keys))
+	}
+	if _, has := c.m[""]; has {
+		t.Error("want the oldest condition evicted")
+	}
+	if _, has := c.m["x"]; !has {
+		t.Error("want the second condition kept")
+	}
+}
@@ -0,0 +1,4 @@
+// Package sqltest runs the expressions of userutil.ToSQLAt on SQLite and
+// compares the users they match with userutil.RsCheckAt. It is a module of
+// its own so the cgo SQLite driver is not a dependency of userutil
+package sqltest
@@ -0,0 +1,26 @@
+module github.com/subiz/userutil/sqltest
+
+go 1.20
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/subiz/header v1.12.72
+	github.com/subiz/userutil v0.0.0
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/subiz/executor/v2 v2.0.3 // indirect
+	github.com/subiz/goutils v0.1.17 // indirect
+	github.com/subiz/log v0.0.34 // indirect
+	github.com/thanhpk/ascii v0.0.4 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto v0.0.0-20230706204954-ccb25ca9f130 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+	google.golang.org/grpc v1.56.2 // indirect
+)
+
+replace github.com/subiz/userutil => ../
@@ -0,0 +1,443 @@
+package sqltest
+
+import (
+	"database/sql"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/subiz/header"
+	apb "github.com/subiz/header/account"
+	"github.com/subiz/userutil"
+	"google.golang.org/protobuf/proto"
+)
+
+func init() {
+	sql.Register("sqlite3_userutil", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for name, fn := range userutil.SQLFunctions {
+				if err := conn.RegisterFunc(name, fn, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+const sqlSchema = `
+CREATE TABLE users (id TEXT NOT NULL, deleted INTEGER NOT NULL);
+CREATE TABLE user_attributes (user_id TEXT NOT NULL, key TEXT NOT NULL, text_raw TEXT NOT NULL,
+  text TEXT NOT NULL, text_lower TEXT NOT NULL, text_ascii TEXT NOT NULL, text_folded TEXT NOT NULL,
+  has_number INTEGER NOT NULL, number REAL, has_datetime INTEGER NOT NULL, datetime INTEGER NOT NULL,
+  boolean INTEGER NOT NULL, local_year INTEGER NOT NULL, local_month INTEGER NOT NULL,
+  local_day INTEGER NOT NULL, local_weekday INTEGER NOT NULL, local_minute INTEGER NOT NULL);
+CREATE TABLE user_list_values (user_id TEXT NOT NULL, key TEXT NOT NULL, text_raw TEXT NOT NULL,
+  text TEXT NOT NULL, text_lower TEXT NOT NULL, text_ascii TEXT NOT NULL, text_folded TEXT NOT NULL);
+`
+
+var sqlDefM = map[string]*header.AttributeDefinition{
+	"name":      {Key: "name", Type: "text"},
+	"email":     {Key: "email", Type: "text"},
+	"phone":     {Key: "phone", Type: "text"},
+	"code":      {Key: "code", Type: "text"},
+	"interests": {Key: "interests", Type: "list"},
+	"score":     {Key: "score", Type: "number"},
+	"score2":    {Key: "score2", Type: "number"},
+	"vip":       {Key: "vip", Type: "boolean"},
+	"vip2":      {Key: "vip2", Type: "boolean"},
+	"seen":      {Key: "seen", Type: "datetime"},
+	"seen2":     {Key: "seen2", Type: "datetime"},
+}
+
+// sqlTexts are the texts of the corpus and the text operands
+var sqlTexts = []string{
+	"", "  ", " Thành Nguyễn ", "thanh", "THANH nguyen", "Nguyễn  Văn   A", "Lan", "lan", "Ñandú", "straße",
+	"lan@acme.com", "Lan.Doe+news@Gmail.com", "+84 912-345-678", "0912.345.678", "(091) 2345 678",
+	"https://www.acme.com/pricing?x=1", "ABC-123", "abc-123-x", "golf, Tennis", `["golf","tennis"]`,
+	"VIP", "vip ", "Paid", "th", "an", "acme", "0912", "nguyen", "*an*", "th?nh", "a*", "ten",
+}
+
+var sqlNumberTexts = []string{"12", " 7.5 ", "-3", "0", "nan", "1e3", "abc", "100"}
+
+var sqlRegexes = []string{"^th", "an$", `\d{3}`, "ng(uy|)en", "[a-z]+@", "(lan"}
+
+// sqlCorpus generates users and conditions around now
+type sqlCorpus struct {
+	r   *rand.Rand
+	now time.Time
+}
+
+func (c *sqlCorpus) pick(vals []string) string { return vals[c.r.Intn(len(vals))] }
+
+// some returns up to 3 values, none once in a while
+func (c *sqlCorpus) some(vals []string) []string {
+	out := []string{}
+	for n := c.r.Intn(4); n > 0; n-- {
+		out = append(out, c.pick(vals))
+	}
+	return out
+}
+
+func (c *sqlCorpus) date() string {
+	var t time.Time
+	switch c.r.Intn(6) {
+	case 0:
+		t = time.Date(2020, 2, 29, c.r.Intn(24), c.r.Intn(60), 0, 0, time.UTC)
+	case 1:
+		t = c.now.Add(time.Duration(c.r.Intn(3*86400)-2*86400) * time.Second)
+	default:
+		t = c.now.Add(time.Duration(c.r.Int63n(800*86400)-500*86400) * time.Second)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (c *sqlCorpus) users(n int) []*header.User {
+	users := []*header.User{}
+	for i := 0; i < n; i++ {
+		u := &header.User{Id: c.pick([]string{"U", "u", "Thành"}) + strconv.Itoa(i), Channel: c.pick([]string{"web", "Zalo", ""})}
+		if c.r.Intn(8) == 0 {
+			u.Deleted = 1
+		}
+		attrs := []*header.Attribute{
+			{Key: "name", Text: c.pick(sqlTexts)},
+			{Key: "email", Text: c.pick(sqlTexts)},
+			{Key: "phone", Text: c.pick(sqlTexts)},
+			{Key: "code", Text: c.pick(append(sqlNumberTexts, "2023-07-10", "12/07/2023", "2023-02-28 23:30:00", c.date(),
+				strconv.FormatInt(c.now.Add(-time.Hour).UnixMilli(), 10)))},
+			{Key: "interests", Text: c.pick([]string{"golf, Tennis", `["golf","tennis"]`, "", "chess", "golf,golf"})},
+			{Key: "score", Number: []float64{-3, 0, 2, 7, 7.5, 7.0000001, 12, 100}[c.r.Intn(8)]},
+			{Key: "score2", Number: []float64{0, 7, 12}[c.r.Intn(3)]},
+			{Key: "vip", Boolean: c.r.Intn(2) == 0},
+			{Key: "vip2", Boolean: c.r.Intn(2) == 0},
+			{Key: "seen", Datetime: c.date()},
+			{Key: "seen2", Datetime: c.pick([]string{c.date(), "yesterday"})},
+		}
+		for _, attr := range attrs {
+			if c.r.Intn(6) > 0 {
+				u.Attributes = append(u.Attributes, attr)
+			}
+		}
+		for _, label := range c.some([]string{"VIP", "vip ", "Paid", "trial", "Khách hàng"}) {
+			u.Labels = append(u.Labels, &header.Label{Label: label})
+		}
+		u.LeadOwners = c.some([]string{"ag1", "ag2", "Ag3"})
+		for _, seg := range c.some([]string{"sg1", "sg2"}) {
+			u.Segments = append(u.Segments, &header.UserSegment{SegmentId: seg})
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+// the ops and transforms with valid arguments, see the tables of
+// validate.go
+var (
+	textOps = []string{"any", "has_value", "is_empty", "eq", "neq", "regex", "start_with", "end_with", "contain",
+		"not_contain", "not_start_with", "not_end_with", "edit_distance:0", "edit_distance:2", "similarity:0.8",
+		"similarity:1", "sounds_like", "contain_word", "not_contain_word", "wildcard", "not_wildcard", "in_set",
+		"not_in_set", "length_eq:0", "length_eq:10", "length_gt:3", "length_lt:3"}
+	setTextOps = []string{"contains_any", "contains_all", "contains_none", "subset_of", "equals_set",
+		"size_eq:0", "size_gt:1", "size_lt:1"}
+	textTransforms = []string{"trim", "lower_case", "upper_case", "remove_spaces", "strip_diacritics",
+		"collapse_whitespace", "normalize_email", "email_domain", "url_host", "url_path", "normalize_phone",
+		"normalize_phone:e164", "normalize_phone:e164,1", "normalize_phone:e164,+84", "substring:0",
+		"substring:-3", "substring:1,3", "split_part:-,1", "split_part:,,,-1", "split_part: ,2"}
+	floatOps        = []string{"has_value", "is_empty", "eq", "neq", "gt", "lt", "gte", "lte", "in_range", "not_in_range"}
+	floatTransforms = []string{"abs", "floor", "ceil", "log", "log10", "round", "round:2", "multiply:2",
+		"multiply:-0.5", "divide:1000", "clamp:0,10", "clamp:-1,-1"}
+	datetimeOps = []string{"any", "unset", "has_value", "in_business_hour", "non_business_hour",
+		"today", "yesterday", "tomorrow", "this_week", "last_week", "next_week", "this_month", "last_month",
+		"next_month", "this_quarter", "last_quarter", "this_year", "last_year", "this_fiscal_quarter",
+		"last_fiscal_quarter", "this_fiscal_year", "last_fiscal_year", "date_last_30mins", "date_last_2hours",
+		"date_last_24h", "date_last_7days", "date_last_30days", "last", "before_ago", "days_of_week", "after",
+		"before", "between", "outside", "anniversary_today", "anniversary_in_next:0", "anniversary_in_next:30",
+		"month_is:1", "month_is:jan,December,12", "day_of_month_is:1", "day_of_month_is:15,31", "next:0",
+		"next:3600", "after_from_now:60", "time_of_day:09:00,17:30", "time_of_day:22:00,06:00",
+		"business_hours_last:3600", "business_hours_last:36000", "business_hours_last:864000",
+		"business_hours_last:-5", "business_hours_before_ago:0", "business_hours_before_ago:3600",
+		"business_hours_before_ago:36000", "business_hours_before_ago:864000", "business_hours_before_ago:-5"}
+	boolOps = []string{"has_value", "true", "false"}
+)
+
+func (c *sqlCorpus) text(op string, transforms []string, caseSensitive, accentSensitive bool) *header.TextCondition {
+	text := &header.TextCondition{
+		Op: op, Regex: c.pick(sqlRegexes), CaseSensitive: caseSensitive, AccentSensitive: accentSensitive,
+		Eq: c.some(sqlTexts), Neq: c.some(sqlTexts), StartWith: c.some(sqlTexts), EndWith: c.some(sqlTexts),
+		Contain: c.some(sqlTexts), NotContain: c.some(sqlTexts), NotStartWith: c.some(sqlTexts),
+	}
+	for _, name := range transforms {
+		text.Transforms = append(text.Transforms, &header.TextTransform{Name: name})
+	}
+	return text
+}
+
+func (c *sqlCorpus) number(op string, transforms []string) *header.FloatCondition {
+	nums := []float64{-3, 0, 2, 7, 7.5, 12, 1000}
+	num := func() float64 { return nums[c.r.Intn(len(nums))] }
+	number := &header.FloatCondition{
+		Op: op, Gt: num(), Lt: num(), Gte: num(), Lte: num(), HasValue: c.r.Intn(2) == 0,
+		InRange: []float64{num(), num()}, NotInRange: []float64{num(), num()},
+	}
+	for n := c.r.Intn(3); n > 0; n-- {
+		number.Eq, number.Neq = append(number.Eq, num()), append(number.Neq, num())
+	}
+	for _, name := range transforms {
+		number.Transforms = append(number.Transforms, &header.FloatTransform{Name: name})
+	}
+	return number
+}
+
+func (c *sqlCorpus) datetime(op string) *header.DatetimeCondition {
+	ms := func() int64 {
+		t, _ := time.Parse(time.RFC3339, c.date())
+		return t.UnixMilli()
+	}
+	secs := []int64{0, 3600, 86400, 3 * 86400, 40 * 86400}
+	return &header.DatetimeCondition{
+		Op: op, Last: secs[c.r.Intn(len(secs))], BeforeAgo: secs[c.r.Intn(len(secs))],
+		After: ms(), Before: ms(), Between: []int64{ms(), ms()}, Outside: []int64{ms(), ms()},
+		DaysOfWeek: c.some([]string{"Monday", "sunday", "Saturday", "Funday"}),
+	}
+}
+
+// leaves returns conditions using every op with every transform and
+// sensitivity, on random keys. Text ops, which do not depend on the time,
+// are only generated with texts
+func (c *sqlCorpus) leaves(texts bool) []*header.UserViewCondition {
+	textKeys := []string{"id", "channel", "attr:name", "attr.email", "attr:phone", "attr:code", "attr:interests",
+		"labels", "lead_owners", "segment", "attr:missing", "unknown"}
+	transforms := [][]string{nil, {"trim", "lower_case"}, {"collapse_whitespace", "strip_diacritics"}}
+	for _, name := range textTransforms {
+		transforms = append(transforms, []string{name})
+	}
+
+	var leaves []*header.UserViewCondition
+	for i, op := range append(textOps, setTextOps...) {
+		if !texts {
+			break
+		}
+		for _, tr := range transforms {
+			for sensitivity := 0; sensitivity < 4; sensitivity++ {
+				leaves = append(leaves, &header.UserViewCondition{Key: c.pick(textKeys),
+					Text: c.text(op, tr, sensitivity&1 > 0, sensitivity&2 > 0)})
+			}
+		}
+		if i >= len(textOps) {
+			// set ops take no quantifier
+			continue
+		}
+		for _, quantifier := range []string{"any/", "all/", "none/", "exactly:1/", "at_least:2/"} {
+			for i := 0; i < 3; i++ {
+				leaves = append(leaves, &header.UserViewCondition{Key: c.pick(textKeys),
+					Text: c.text(quantifier+op, transforms[c.r.Intn(len(transforms))], c.r.Intn(2) == 0, c.r.Intn(2) == 0)})
+			}
+		}
+	}
+
+	ftransforms := [][]string{nil, {"abs", "multiply:-0.5", "clamp:0,10"}, {"log", "round:2"}}
+	for _, name := range floatTransforms {
+		ftransforms = append(ftransforms, []string{name})
+	}
+	for _, op := range floatOps {
+		for _, tr := range ftransforms {
+			for _, key := range []string{"attr:score", "attr:code", "attr:vip"} {
+				leaves = append(leaves, &header.UserViewCondition{Key: key, Number: c.number(op, tr)})
+			}
+		}
+	}
+
+	for _, op := range datetimeOps {
+		for _, key := range []string{"attr:seen", "attr:code"} {
+			leaves = append(leaves, &header.UserViewCondition{Key: key, Datetime: c.datetime(op)})
+		}
+	}
+
+	for _, op := range boolOps {
+		for _, key := range []string{"attr:vip", "attr:missing"} {
+			leaves = append(leaves, &header.UserViewCondition{Key: key, Boolean: &header.BoolCondition{Op: op}})
+		}
+	}
+
+	for _, cmp := range []string{"eq", "neq", "lt", "gt", "lte", "gte", "before", "after"} {
+		leaves = append(leaves,
+			&header.UserViewCondition{Key: "attr:name", Text: c.text("compare:"+cmp+",attr:email", transforms[c.r.Intn(len(transforms))], c.r.Intn(2) == 0, c.r.Intn(2) == 0)},
+			&header.UserViewCondition{Key: "attr:score", Number: c.number("compare:"+cmp+",attr:score2", ftransforms[c.r.Intn(len(ftransforms))])},
+			&header.UserViewCondition{Key: "attr:seen", Datetime: c.datetime("compare:" + cmp + ",attr:seen2")},
+			&header.UserViewCondition{Key: "attr:vip", Boolean: &header.BoolCondition{Op: "compare:" + cmp + ",attr:vip2"}},
+			&header.UserViewCondition{Key: "attr:name", Text: c.text("compare:"+cmp+",attr:score", nil, false, false)},
+		)
+	}
+
+	for _, keyword := range []string{"thanh ng", "0912345", "u1", "LAN", "", "acme.com"} {
+		leaves = append(leaves, &header.UserViewCondition{Key: "keyword", Text: &header.TextCondition{Op: "contain", Contain: []string{keyword}}})
+	}
+	leaves = append(leaves, &header.UserViewCondition{Key: "keyword", Text: &header.TextCondition{Op: "contain"}})
+	return leaves
+}
+
+// tree combines random leaves into not, one and all nodes
+func (c *sqlCorpus) tree(leaves []*header.UserViewCondition, depth int) *header.UserViewCondition {
+	if depth == 0 || c.r.Intn(3) == 0 {
+		return leaves[c.r.Intn(len(leaves))]
+	}
+	node := &header.UserViewCondition{}
+	children := []*header.UserViewCondition{}
+	for n := c.r.Intn(3) + 1; n > 0; n-- {
+		children = append(children, c.tree(leaves, depth-1))
+	}
+	if c.r.Intn(2) == 0 {
+		node.One = children
+	} else {
+		node.All = children
+	}
+	if c.r.Intn(3) == 0 {
+		node.Key = userutil.NotKey
+	}
+	return node
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3_userutil", ":memory:")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skipf("sqlite is unavailable: %v", err)
+	}
+	// each connection has its own in-memory database
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqlSchema); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func insertSQLRows(t *testing.T, db *sql.DB, ctx *userutil.EvalContext, acc *apb.Account, users []*header.User) {
+	for _, u := range users {
+		if _, err := db.Exec("INSERT INTO users VALUES (?, ?)", u.Id, u.Deleted); err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range userutil.SQLRows(ctx, acc, sqlDefM, u) {
+			var err error
+			if row.List {
+				_, err = db.Exec("INSERT INTO user_list_values VALUES (?, ?, ?, ?, ?, ?, ?)", u.Id, row.Key, row.TextRaw,
+					row.Text, row.TextLower, row.TextASCII, row.TextFolded)
+			} else {
+				_, err = db.Exec("INSERT INTO user_attributes VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+					u.Id, row.Key, row.TextRaw, row.Text, row.TextLower, row.TextASCII, row.TextFolded,
+					row.HasNumber, row.Number, row.HasDatetime, row.Datetime, row.Boolean,
+					row.LocalYear, row.LocalMonth, row.LocalDay, row.LocalWeekday, row.LocalMinute)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestSQLMatchesRsCheck runs userutil.ToSQLAt on SQLite against a random corpus and
+// compares the users it returns with userutil.RsCheckAt
+func TestSQLMatchesRsCheck(t *testing.T) {
+	newYork := &apb.Account{Timezone: proto.String("America/New_York"), BusinessHours: &apb.BusinessHours{
+		WorkingDays: []*apb.BusinessHours_WorkingDay{
+			{Weekday: proto.String("Monday"), StartTime: proto.String("08:00"), EndTime: proto.String("17:30")},
+			{Weekday: proto.String("Everyday"), StartTime: proto.String("9:00"), EndTime: proto.String("12:00")},
+			{Weekday: proto.String("Friday"), StartTime: proto.String("13:00"), EndTime: proto.String("18")},
+			{Weekday: proto.String("Saturday"), StartTime: proto.String("25:00"), EndTime: proto.String("12:00")},
+			{Weekday: proto.String("Saturday"), StartTime: proto.String("14:00"), EndTime: proto.String("15:00")},
+			{Weekday: proto.String("Sunday"), StartTime: proto.String(" 13:00"), EndTime: proto.String("14:00")},
+		},
+		Holidays: []*apb.BusinessHours_Holiday{
+			{Year: proto.Int32(2023), Month: proto.Int32(7), Day: proto.Int32(4)},
+			{Year: proto.Int32(2023), Month: proto.Int32(7), Day: proto.Int32(10)},
+		},
+	}}
+	bangkok := &apb.Account{Timezone: proto.String("+07:00"), BusinessHours: &apb.BusinessHours{
+		WorkingDays: []*apb.BusinessHours_WorkingDay{
+			{Weekday: proto.String("Everyday"), StartTime: proto.String("0:00"), EndTime: proto.String("23:59")},
+		},
+		Holidays: []*apb.BusinessHours_Holiday{{Year: proto.Int32(2023), Month: proto.Int32(2), Day: proto.Int32(27)}},
+	}}
+
+	scenarios := []struct {
+		ctx *userutil.EvalContext
+		acc *apb.Account
+	}{
+		{&userutil.EvalContext{Now: time.Date(2023, 7, 12, 14, 5, 30, 500, time.UTC)}, newYork},
+		{&userutil.EvalContext{Now: time.Date(2023, 2, 28, 3, 0, 0, 0, time.UTC), WeekStart: "sunday", FiscalYearStartMonth: time.April}, bangkok},
+		{&userutil.EvalContext{Now: time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)}, nil},
+	}
+
+	for i, s := range scenarios {
+		i, s := i, s
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+			testSQLParity(t, s.ctx, s.acc, int64(i), i == 0)
+		})
+	}
+}
+
+// testSQLParity compares userutil.ToSQLAt with userutil.RsCheckAt on a corpus generated from
+// seed, with every text op when texts is set
+func testSQLParity(t *testing.T, ctx *userutil.EvalContext, acc *apb.Account, seed int64, texts bool) {
+	db := openSQLite(t)
+	defer db.Close()
+	c := &sqlCorpus{r: rand.New(rand.NewSource(seed)), now: ctx.Now}
+	users := c.users(40)
+	insertSQLRows(t, db, ctx, acc, users)
+
+	leaves := c.leaves(texts)
+	conds := leaves
+	for range leaves {
+		cond := c.tree(leaves, 3)
+		if c.r.Intn(5) == 0 {
+			cond = proto.Clone(cond).(*header.UserViewCondition)
+			cond.Deleted = true
+		}
+		conds = append(conds, cond)
+	}
+
+	failures := 0
+	for _, cond := range conds {
+		where, args, err := userutil.ToSQLAt(ctx, acc, sqlDefM, cond, userutil.DialectSQLite)
+		if _, cerr := userutil.Compile(acc, sqlDefM, cond); (cerr == nil) != (err == nil) {
+			t.Fatalf("%v: compile error %v, sql error %v", cond, cerr, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		rows, err := db.Query("SELECT u.id FROM users u WHERE "+where, args...)
+		if err != nil {
+			t.Fatalf("%v: %v\n%s", cond, err, where)
+		}
+		got := map[string]bool{}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			got[id] = true
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("%v: %v", cond, err)
+		}
+		rows.Close()
+
+		for _, u := range users {
+			want, err := userutil.RsCheckAt(ctx, acc, sqlDefM, u, cond, cond.GetDeleted())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got[u.Id] != want {
+				t.Errorf("%v on %v: sql %v, userutil.RsCheckAt %v", cond, u, got[u.Id], want)
+				if failures++; failures > 20 {
+					t.FailNow()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package userutil
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// operandTransforms canonicalize a value rather than extract a part of it,
+// they are applied to the operands too so an operand written the way users
+// type it, e.g: 0912 345 678, compares with the transformed values
+var operandTransforms = map[string]bool{
+	"remove_spaces": true, "strip_diacritics": true, "collapse_whitespace": true,
+	"normalize_phone": true, "normalize_email": true,
+}
+
+// DefaultPhoneCountryCode is used by normalize_phone:e164 for national
+// numbers when no country code is given
+const DefaultPhoneCountryCode = "84"
+
+// normalizePhone keeps only the digits of a phone number. With argument
+// "e164" (e.g: normalize_phone:e164 or normalize_phone:e164,1) the number is
+// converted to E.164: +84912345678. Only numbers written with a leading +
+// or 00 hold a country code, others are national numbers, e.g: 84 912 345
+// 678 is +8484912345678 when the code is 84
+func normalizePhone(str string, args []string) string {
+	str = strings.TrimSpace(str)
+	var b strings.Builder
+	for _, ch := range str {
+		if ch >= '0' && ch <= '9' {
+			b.WriteRune(ch)
+		}
+	}
+	digits := b.String()
+	if len(args) == 0 || strings.TrimSpace(args[0]) != "e164" || digits == "" {
+		return digits
+	}
+
+	cc := DefaultPhoneCountryCode
+	if len(args) > 1 && strings.TrimSpace(args[1]) != "" {
+		cc = strings.TrimPrefix(strings.TrimSpace(args[1]), "+")
+	}
+
+	switch {
+	case strings.HasPrefix(str, "+"):
+		return "+" + digits
+	case strings.HasPrefix(digits, "00"):
+		return "+" + digits[2:]
+	case strings.HasPrefix(digits, "0"):
+		return "+" + cc + digits[1:]
+	}
+	return "+" + cc + digits
+}
+
+// normalizeEmail lower-cases the address and strips the +tag of the local
+// part, gmail addresses also drop their dots since gmail ignores them
+func normalizeEmail(str string) string {
+	str = strings.ToLower(strings.TrimSpace(str))
+	at := strings.LastIndex(str, "@")
+	if at < 0 {
+		return str
+	}
+
+	local, domain := str[:at], str[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+		domain = "gmail.com"
+	}
+	return local + "@" + domain
+}
+
+func emailDomain(str string) string {
+	str = strings.TrimSpace(str)
+	at := strings.LastIndex(str, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(str[at+1:])
+}
+
+// parseURL parses str as an absolute url, urls without scheme such as
+// subiz.com/pricing are accepted
+func parseURL(str string) *url.URL {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return nil
+	}
+	if !strings.Contains(str, "://") {
+		str = "http://" + str
+	}
+	u, err := url.Parse(str)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// substring takes the runes of str from start, with an optional length:
+// substring:0,3. A negative start counts from the end
+func substring(str string, args []string) string {
+	if len(args) == 0 || len(args) > 2 {
+		return str
+	}
+	runes := []rune(str)
+	start, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil {
+		return str
+	}
+	if start < 0 {
+		start += len(runes)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > len(runes) {
+		return ""
+	}
+
+	end := len(runes)
+	if len(args) == 2 {
+		length, err := strconv.Atoi(strings.TrimSpace(args[1]))
+		if err != nil || length < 0 {
+			return str
+		}
+		if start+length < end {
+			end = start + length
+		}
+	}
+	return string(runes[start:end])
+}
+
+// splitPart splits str by a separator and returns the n-th part (1-based,
+// negative counts from the end), e.g: split_part:@,2. The separator is
+// every argument but the last one so it may contain commas
+func splitPart(str string, args []string) string {
+	if len(args) < 2 {
+		return str
+	}
+	sep := strings.Join(args[:len(args)-1], ",")
+	n, err := strconv.Atoi(strings.TrimSpace(args[len(args)-1]))
+	if err != nil || n == 0 || sep == "" {
+		return str
+	}
+
+	parts := strings.Split(str, sep)
+	if n < 0 {
+		n += len(parts) + 1
+	}
+	if n < 1 || n > len(parts) {
+		return ""
+	}
+	return parts[n-1]
+}
+
+// parseNumberText parses a number stored as text, e.g: " 12.5 "
+func parseNumberText(str string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
@@ -0,0 +1,176 @@
+package userutil
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/subiz/header"
+)
+
+func TestTextTransforms(t *testing.T) {
+	transforms := func(names ...string) []*header.TextTransform {
+		out := []*header.TextTransform{}
+		for _, name := range names {
+			out = append(out, &header.TextTransform{Name: name})
+		}
+		return out
+	}
+
+	cases := []struct {
+		value string
+		cond  *header.TextCondition
+		want  bool
+	}{
+		// operands are normalized like the values
+		{"+84 912-345-678", &header.TextCondition{Op: "eq", Eq: []string{"0912 345 678"}, Transforms: transforms("normalize_phone:e164")}, true},
+		{"0912.345.678", &header.TextCondition{Op: "eq", Eq: []string{"(091) 2345 678"}, Transforms: transforms("normalize_phone")}, true},
+		{"0912.345.678", &header.TextCondition{Op: "in_set", Eq: []string{"0912 345 679", "0912 345 678"}, Transforms: transforms("normalize_phone")}, true},
+		{"0912.345.679", &header.TextCondition{Op: "neq", Neq: []string{"0912 345 678"}, Transforms: transforms("normalize_phone")}, true},
+		{"John.Doe+news@Gmail.com", &header.TextCondition{Op: "eq", Eq: []string{"johndoe+promo@gmail.com"}, Transforms: transforms("normalize_email")}, true},
+		{"Nguyễn  Văn   A", &header.TextCondition{Op: "eq", Eq: []string{"Nguyễn Văn   A"}, Transforms: transforms("collapse_whitespace"), AccentSensitive: true}, true},
+		{"Nguyễn Văn A", &header.TextCondition{Op: "eq", Eq: []string{"Nguyen Văn A"}, Transforms: transforms("strip_diacritics"), AccentSensitive: true}, true},
+		{"ab c", &header.TextCondition{Op: "start_with", StartWith: []string{"a b"}, Transforms: transforms("remove_spaces")}, true},
+
+		// extracting transforms only apply to the values
+		{"Lan@Acme.com", &header.TextCondition{Op: "eq", Eq: []string{"acme.com"}, Transforms: transforms("email_domain")}, true},
+		{"https://www.acme.com/pricing?x=1", &header.TextCondition{Op: "eq", Eq: []string{"/pricing"}, Transforms: transforms("url_path")}, true},
+		{"ABC-123", &header.TextCondition{Op: "eq", Eq: []string{"123"}, Transforms: transforms("split_part:-,2")}, true},
+		{"ABCDEF", &header.TextCondition{Op: "eq", Eq: []string{"bcd"}, Transforms: transforms("substring:1,3")}, true},
+		{"ABCDEF", &header.TextCondition{Op: "eq", Eq: []string{"ef"}, Transforms: transforms("substring:-2")}, true},
+
+		// wildcard operands are patterns
+		{"0912.345.678", &header.TextCondition{Op: "wildcard", Eq: []string{"0912*"}, Transforms: transforms("normalize_phone")}, true},
+	}
+
+	for _, c := range cases {
+		if got := EvaluateText(true, c.value, c.cond); got != c.want {
+			t.Errorf("%q %s %v %v: got %v, want %v", c.value, c.cond.GetOp(), c.cond.GetTransforms(), textOperands(c.cond, textOperandField(c.cond.GetOp())), got, c.want)
+		}
+	}
+}
+
+func TestSubstringArguments(t *testing.T) {
+	for args, want := range map[string]bool{
+		"substring:0":     true,
+		"substring:-3":    true,
+		"substring:1,3":   true,
+		"substring:1.5":   false,
+		"substring:1,2.0": false,
+		"substring:1,-1":  false,
+		"substring:":      false,
+		"substring:1,2,3": false,
+	} {
+		cond := &header.UserViewCondition{Key: "id", Text: &header.TextCondition{
+			Op: "eq", Eq: []string{"a"}, Transforms: []*header.TextTransform{{Name: args}},
+		}}
+		if got := len(ValidateCondition(nil, cond)) == 0; got != want {
+			t.Errorf("%s: valid %v, want %v", args, got, want)
+		}
+	}
+}
+
+func TestFloatTransforms(t *testing.T) {
+	transforms := func(names ...string) []*header.FloatTransform {
+		out := []*header.FloatTransform{}
+		for _, name := range names {
+			out = append(out, &header.FloatTransform{Name: name})
+		}
+		return out
+	}
+
+	cases := []struct {
+		value      float64
+		transforms []*header.FloatTransform
+		want       float64
+	}{
+		{-3, transforms("abs"), 3},
+		{2.5, transforms("round"), 3},
+		{-2.5, transforms("round"), -3},
+		{1.2345, transforms("round:2"), 1.23},
+		{2.7, transforms("floor"), 2},
+		{-2.1, transforms("floor"), -3},
+		{2.1, transforms("ceil"), 3},
+		{3, transforms("multiply:2"), 6},
+		{4, transforms("multiply:-0.5"), -2},
+		{1500, transforms("divide:1000"), 1.5},
+		{15, transforms("clamp:0,10"), 10},
+		{-5, transforms("clamp:0,10"), 0},
+		{5, transforms("clamp:0,10"), 5},
+		{math.E, transforms("log"), 1},
+		{1000, transforms("log10"), 3},
+
+		// transforms apply in order
+		{1500, transforms("divide:1000", "round"), 2},
+		{1500, transforms("round", "divide:1000"), 1.5},
+		{-25, transforms("abs", "clamp:0,10", "multiply:3"), 30},
+		{-25, transforms("clamp:0,10", "abs", "multiply:3"), 0},
+	}
+
+	for _, c := range cases {
+		if got := applyFloatTransform(c.value, c.transforms); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%v %v: got %v, want %v", c.value, c.transforms, got, c.want)
+		}
+	}
+}
+
+func TestFloatTolerance(t *testing.T) {
+	cases := []struct {
+		value float64
+		cond  *header.FloatCondition
+		want  bool
+	}{
+		// eq and neq compare with Tolerance
+		{0.1 + 0.2, &header.FloatCondition{Op: "eq", Eq: []float64{0.3}}, true},
+		{0.1 + 0.2, &header.FloatCondition{Op: "neq", Neq: []float64{0.3}}, false},
+		{1 + Tolerance/10, &header.FloatCondition{Op: "eq", Eq: []float64{1}}, true},
+		{1 + Tolerance*10, &header.FloatCondition{Op: "eq", Eq: []float64{1}}, false},
+		{1 + Tolerance*10, &header.FloatCondition{Op: "neq", Neq: []float64{1}}, true},
+		{3, &header.FloatCondition{Op: "eq", Eq: []float64{0.3}, Transforms: []*header.FloatTransform{{Name: "multiply:0.1"}}}, true},
+		{1, &header.FloatCondition{Op: "eq", Eq: []float64{0.333333}, Transforms: []*header.FloatTransform{{Name: "divide:3"}}}, true},
+		{2, &header.FloatCondition{Op: "eq", Eq: []float64{0.66}, Transforms: []*header.FloatTransform{{Name: "divide:3"}}}, false},
+
+		// transforms apply before the op
+		{1234.5678, &header.FloatCondition{Op: "eq", Eq: []float64{1234.57}, Transforms: []*header.FloatTransform{{Name: "round:2"}}}, true},
+		{-7, &header.FloatCondition{Op: "gt", Gt: 5, Transforms: []*header.FloatTransform{{Name: "abs"}}}, true},
+		{1500, &header.FloatCondition{Op: "in_range", InRange: []float64{1, 2}, Transforms: []*header.FloatTransform{{Name: "divide:1000"}}}, true},
+	}
+
+	for _, c := range cases {
+		if got := EvaluateFloat(true, c.value, c.cond); got != c.want {
+			t.Errorf("%v %s %v: got %v, want %v", c.value, c.cond.GetOp(), c.cond.GetTransforms(), got, c.want)
+		}
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	cases := []struct {
+		value, args, want string
+	}{
+		{"0912 345 678", "", "0912345678"},
+		{"+84 912-345-678", "", "84912345678"},
+		{"0912 345 678", "e164", "+84912345678"},
+		{"+84 912 345 678", "e164", "+84912345678"},
+		{"0084 912 345 678", "e164", "+84912345678"},
+		{"(415) 555-0100", "e164,1", "+14155550100"},
+		{"0415 555 0100", "e164,+1", "+14155550100"},
+
+		// without + nor 00 the digits are national even when they start
+		// like the country code
+		{"912 345 678", "e164", "+84912345678"},
+		{"84 912 345 678", "e164", "+8484912345678"},
+		{"844 123 456", "e164", "+84844123456"},
+		{"1 415 555 0100", "e164,1", "+114155550100"},
+		{"", "e164", ""},
+	}
+
+	for _, c := range cases {
+		var args []string
+		if c.args != "" {
+			args = strings.Split(c.args, ",")
+		}
+		if got := normalizePhone(c.value, args); got != c.want {
+			t.Errorf("%q %s: got %q, want %q", c.value, c.args, got, c.want)
+		}
+	}
+}
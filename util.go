@@ -3,6 +3,7 @@ package userutil
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"math"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"sync"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/subiz/executor/v2"
 	"github.com/subiz/goutils/business_hours"
@@ -35,117 +37,498 @@ func applyTextTransform(str string, transforms []*header.TextTransform) string {
 		return str
 	}
 
-	transform := transforms[0]
-	if transform.GetName() == "trim" {
+	name, args := splitOp(transforms[0].GetName())
+	switch name {
+	case "trim":
 		str = strings.TrimSpace(str)
+	case "lower_case":
+		str = strings.ToLower(str)
+	case "upper_case":
+		str = strings.ToUpper(str)
+	case "remove_spaces":
+		str = SpaceStringsBuilder(str)
+	case "strip_diacritics":
+		str = ascii.Convert(str)
+	case "collapse_whitespace":
+		str = strings.Join(strings.Fields(str), " ")
+	case "normalize_phone":
+		str = normalizePhone(str, args)
+	case "normalize_email":
+		str = normalizeEmail(str)
+	case "email_domain":
+		str = emailDomain(str)
+	case "url_host":
+		if u := parseURL(str); u != nil {
+			str = strings.ToLower(u.Hostname())
+		} else {
+			str = ""
+		}
+	case "url_path":
+		if u := parseURL(str); u != nil {
+			str = u.Path
+		} else {
+			str = ""
+		}
+	case "substring":
+		str = substring(str, args)
+	case "split_part":
+		str = splitPart(str, args)
 	}
 
-	if transform.GetName() == "lower_case" {
-		str = strings.ToLower(str)
+	return applyTextTransform(str, transforms[1:])
+}
+
+// splitOp splits an op carrying its own arguments, e.g: "month_is:1,2"
+// into its name "month_is" and arguments ["1", "2"]
+func splitOp(op string) (string, []string) {
+	name, args, found := strings.Cut(op, ":")
+	if !found {
+		return op, nil
 	}
+	return name, strings.Split(args, ",")
+}
 
-	if transform.GetName() == "upper_case" {
-		str = strings.ToUpper(str)
+// intArg parses the single integer argument of an op, e.g: "next:3600"
+func intArg(args []string) (int64, bool) {
+	if len(args) != 1 {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(strings.TrimSpace(args[0]), 10, 64)
+	if err != nil {
+		return 0, false
 	}
+	return i, true
+}
 
-	return applyTextTransform(str, transforms[1:])
+// floatArgs parses the numeric arguments of an op or a transform
+func floatArgs(args []string) ([]float64, bool) {
+	out := make([]float64, 0, len(args))
+	for _, arg := range args {
+		f, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return nil, false
+		}
+		out = append(out, f)
+	}
+	return out, true
 }
 
 func applyFloatTransform(fl float64, transforms []*header.FloatTransform) float64 {
-	return fl
+	if len(transforms) == 0 {
+		return fl
+	}
+
+	name, args := splitOp(transforms[0].GetName())
+	nums, _ := floatArgs(args)
+
+	switch name {
+	case "abs":
+		fl = math.Abs(fl)
+	case "round":
+		if len(nums) == 1 { // round:2 keeps 2 decimals
+			pow := math.Pow(10, nums[0])
+			fl = math.Round(fl*pow) / pow
+		} else {
+			fl = math.Round(fl)
+		}
+	case "floor":
+		fl = math.Floor(fl)
+	case "ceil":
+		fl = math.Ceil(fl)
+	case "multiply":
+		if len(nums) == 1 {
+			fl = fl * nums[0]
+		}
+	case "divide":
+		if len(nums) == 1 && nums[0] != 0 {
+			fl = fl / nums[0]
+		}
+	case "clamp":
+		if len(nums) == 2 {
+			fl = math.Max(nums[0], math.Min(nums[1], fl))
+		}
+	case "log":
+		fl = math.Log(fl)
+	case "log10":
+		fl = math.Log10(fl)
+	}
+
+	return applyFloatTransform(fl, transforms[1:])
 }
 
-func EvaluateText(has bool, str string, cond *header.TextCondition) bool {
-	str = applyTextTransform(str, cond.GetTransforms())
-	if !cond.GetCaseSensitive() {
+// textOperandField returns the TextCondition field holding the operands of
+// op, empty when op takes no operand
+func textOperandField(op string) string {
+	switch op {
+	case "eq", "edit_distance", "similarity", "sounds_like", "wildcard", "in_set",
+		"contains_any", "contains_all", "contains_none", "subset_of", "equals_set":
+		return "eq"
+	case "neq", "not_wildcard", "not_in_set":
+		return "neq"
+	case "start_with":
+		return "start_with"
+	case "end_with", "not_end_with":
+		return "end_with"
+	case "contain", "contain_word":
+		return "contain"
+	case "not_contain", "not_contain_word":
+		return "not_contain"
+	case "not_start_with":
+		return "not_start_with"
+	}
+	return ""
+}
+
+func textOperands(cond *header.TextCondition, field string) []string {
+	switch field {
+	case "eq":
+		return cond.GetEq()
+	case "neq":
+		return cond.GetNeq()
+	case "start_with":
+		return cond.GetStartWith()
+	case "end_with":
+		return cond.GetEndWith()
+	case "contain":
+		return cond.GetContain()
+	case "not_contain":
+		return cond.GetNotContain()
+	case "not_start_with":
+		return cond.GetNotStartWith()
+	}
+	return nil
+}
+
+// textMatcher holds a TextCondition with its operands already folded
+// (lower case, ascii) and trimmed, so they are normalized only once no
+// matter how many values are evaluated against it
+type textMatcher struct {
+	cond     *header.TextCondition
+	op       string
+	args     []string
+	operands []string
+	re       *regexp.Regexp
+	fuzzy    *fuzzyMatcher
+	words    [][]string
+	globs    []*regexp.Regexp
+	set      map[string]bool
+	length   int64
+
+	// quantifier of multi-valued conditions, see matchAll
+	quantifier string
+	count      int64
+	each       []*textMatcher
+}
+
+// SetThreshold is the number of eq/neq operands from which compiled
+// conditions look them up in a hash set instead of comparing them one by one
+const SetThreshold = 16
+
+func newTextMatcher(cond *header.TextCondition) (*textMatcher, error) {
+	m := &textMatcher{cond: cond}
+	quantifier, count, op, err := splitQuantifier(cond.GetOp())
+	if err != nil {
+		return nil, err
+	}
+	m.quantifier, m.count = quantifier, count
+	m.op, m.args = splitOp(op)
+
+	// wildcard operands are patterns, not values
+	var transforms []*header.TextTransform
+	if m.op != "wildcard" && m.op != "not_wildcard" {
+		for _, transform := range cond.GetTransforms() {
+			if name, _ := splitOp(transform.GetName()); operandTransforms[name] {
+				transforms = append(transforms, transform)
+			}
+		}
+	}
+	operands := textOperands(cond, textOperandField(m.op))
+	for _, cs := range operands {
+		m.operands = append(m.operands, strings.TrimSpace(m.fold(applyTextTransform(cs, transforms))))
+	}
+
+	if m.op == "length_eq" || m.op == "length_gt" || m.op == "length_lt" {
+		n, ok := intArg(m.args)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("%s requires a length", m.op)
+		}
+		m.length = n
+	}
+
+	if m.op == "size_eq" || m.op == "size_gt" || m.op == "size_lt" {
+		n, ok := intArg(m.args)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("%s requires a size", m.op)
+		}
+		m.length = n
+	}
+
+	if setTextOps[m.op] && m.quantifier != "" {
+		return nil, fmt.Errorf("%s compares the whole list and takes no quantifier", m.op)
+	}
+
+	if setTextOps[m.op] {
+		m.buildSet()
+	}
+
+	if m.op == "contain_word" || m.op == "not_contain_word" {
+		for _, cs := range m.operands {
+			m.words = append(m.words, tokenize(cs))
+		}
+	}
+
+	if m.op == "wildcard" || m.op == "not_wildcard" {
+		for _, cs := range m.operands {
+			re, err := CompileRegex(globToRegex(cs))
+			if err != nil {
+				return nil, err
+			}
+			m.globs = append(m.globs, re)
+		}
+	}
+
+	if m.op == "edit_distance" || m.op == "similarity" || m.op == "sounds_like" {
+		fuzzy, err := newFuzzyMatcher(m.op, m.args, m.operands)
+		if err != nil {
+			return nil, err
+		}
+		m.fuzzy = fuzzy
+	}
+
+	if m.op == "regex" {
+		// values are already lower-cased, (?i) keeps classes like \W intact
+		pattern := cond.GetRegex()
+		if !cond.GetAccentSensitive() {
+			pattern = ascii.Convert(pattern)
+		}
+		if !cond.GetCaseSensitive() {
+			pattern = "(?i)" + pattern
+		}
+		re, err := CompileRegex(pattern)
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+
+	if m.quantifier == "all" && !negatedTextOps[m.op] {
+		for i := range m.operands {
+			each, err := m.single(i)
+			if err != nil {
+				return nil, err
+			}
+			m.each = append(m.each, each)
+		}
+	}
+	return m, nil
+}
+
+func (m *textMatcher) buildSet() {
+	m.set = make(map[string]bool, len(m.operands))
+	for _, cs := range m.operands {
+		m.set[cs] = true
+	}
+}
+
+// index looks in_set, not_in_set and large eq/neq operands up in a hash set
+// instead of comparing them one by one. Building the set costs as much as a
+// scan, it only pays off for matchers evaluated against many values
+func (m *textMatcher) index() {
+	if m.set == nil && (m.op == "in_set" || m.op == "not_in_set" ||
+		((m.op == "eq" || m.op == "neq") && len(m.operands) >= SetThreshold)) {
+		m.buildSet()
+	}
+}
+
+// single returns a copy of m matching only its i-th operand
+func (m *textMatcher) single(i int) (*textMatcher, error) {
+	each := *m
+	each.quantifier, each.each, each.set = "", nil, nil
+	each.operands = m.operands[i : i+1]
+	if m.words != nil {
+		each.words = m.words[i : i+1]
+	}
+	if m.globs != nil {
+		each.globs = m.globs[i : i+1]
+	}
+	if m.fuzzy != nil {
+		fuzzy, err := newFuzzyMatcher(m.op, m.args, each.operands)
+		if err != nil {
+			return nil, err
+		}
+		each.fuzzy = fuzzy
+	}
+	return &each, nil
+}
+
+// negatedTextOps match a value when none of the operands matches it
+var negatedTextOps = map[string]bool{
+	"neq": true, "not_in_set": true, "not_contain": true, "not_start_with": true,
+	"not_end_with": true, "not_contain_word": true, "not_wildcard": true,
+}
+
+// setTextOps compare the values of a multi-valued field as a whole with the
+// Eq operands, e.g: contains_all, or count them, e.g: size_gt:2
+var setTextOps = map[string]bool{
+	"contains_any": true, "contains_all": true, "contains_none": true, "subset_of": true, "equals_set": true,
+	"size_eq": true, "size_gt": true, "size_lt": true,
+}
+
+// splitQuantifier splits the quantifier prefix of a text op, e.g:
+// all/eq, none/contain, exactly:2/eq, at_least:2/has_value
+func splitQuantifier(op string) (string, int64, string, error) {
+	i := strings.Index(op, "/")
+	if i < 0 {
+		return "", 0, op, nil
+	}
+
+	quantifier, args := splitOp(op[:i])
+	switch quantifier {
+	case "any", "all", "none":
+		if len(args) > 0 {
+			return quantifier, 0, op[i+1:], fmt.Errorf("%s quantifier takes no argument", quantifier)
+		}
+		return quantifier, 0, op[i+1:], nil
+	case "exactly", "at_least":
+		n, ok := intArg(args)
+		if !ok || n < 0 {
+			return quantifier, 0, op[i+1:], fmt.Errorf("%s quantifier requires a count", quantifier)
+		}
+		return quantifier, n, op[i+1:], nil
+	}
+	return quantifier, 0, op[i+1:], fmt.Errorf("unknown quantifier %q", quantifier)
+}
+
+func (m *textMatcher) fold(str string) string {
+	if !m.cond.GetCaseSensitive() {
 		str = strings.ToLower(str)
 	}
-	if !cond.GetAccentSensitive() {
+	if !m.cond.GetAccentSensitive() {
 		str = ascii.Convert(str)
 	}
+	return str
+}
 
-	switch cond.GetOp() {
+// normalize applies the condition transforms then folds the value the same
+// way the operands were folded
+func (m *textMatcher) normalize(str string) string {
+	return strings.TrimSpace(m.fold(applyTextTransform(str, m.cond.GetTransforms())))
+}
+
+func (m *textMatcher) normalizeAll(strs []string) []string {
+	vals := make([]string, 0, len(strs))
+	for _, str := range strs {
+		vals = append(vals, m.normalize(str))
+	}
+	return vals
+}
+
+// matchLength compares the number of characters of str with the op
+// argument, e.g: length_gt:10
+func (m *textMatcher) matchLength(str string) bool {
+	length := int64(utf8.RuneCountInString(str))
+	switch m.op {
+	case "length_eq":
+		return length == m.length
+	case "length_gt":
+		return length > m.length
+	case "length_lt":
+		return length < m.length
+	}
+	return false
+}
+
+// isOperand tells whether the normalized str equals one of the operands
+func (m *textMatcher) isOperand(str string) bool {
+	if m.set != nil {
+		return m.set[str]
+	}
+	for _, cs := range m.operands {
+		if str == cs {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *textMatcher) match(has bool, str string) bool {
+	if m.quantifier != "" || setTextOps[m.op] {
+		// a single value is quantified as a list of zero or one value
+		if !has {
+			return m.matchAll(nil)
+		}
+		return m.matchAll([]string{str})
+	}
+	return m.test(has, m.normalize(str))
+}
+
+// test tells whether the already normalized str satisfies the op
+func (m *textMatcher) test(has bool, str string) bool {
+	switch m.op {
 	case "any":
 		return true
 	case "has_value":
 		return has
 	case "is_empty":
-		return strings.TrimSpace(str) == ""
+		return str == ""
 	case "eq":
-		if len(cond.GetEq()) == 0 {
+		if len(m.operands) == 0 {
 			return true
 		}
 		if !has {
 			return false
 		}
-		for _, cs := range cond.GetEq() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.TrimSpace(str) == strings.TrimSpace(cs) {
-				return true
-			}
-		}
-		return false
+		return m.isOperand(str)
 	case "neq":
-		if len(cond.GetNeq()) == 0 {
+		if len(m.operands) == 0 {
 			return true
 		}
-
-		for _, cs := range cond.GetNeq() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.TrimSpace(str) == strings.TrimSpace(cs) {
-				return false
-			}
-		}
-		return true
+		return !m.isOperand(str)
+	case "in_set":
+		return has && m.isOperand(str)
+	case "not_in_set":
+		return !has || !m.isOperand(str)
 	case "regex":
 		if !has {
 			return false
 		}
-
-		regexp.MatchString(cond.GetRegex(), str)
+		return m.re.MatchString(str)
+	case "edit_distance", "similarity", "sounds_like":
+		if !has {
+			return false
+		}
+		return m.fuzzy.match(str)
+	case "length_eq", "length_gt", "length_lt":
+		if !has {
+			return false
+		}
+		return m.matchLength(str)
+	case "contain_word", "wildcard":
+		if !has {
+			return false
+		}
+		return m.matchPattern(str)
+	case "not_contain_word", "not_wildcard":
+		if !has {
+			return false
+		}
+		return !m.matchPattern(str)
 	case "start_with":
 		if !has {
 			return false
 		}
-		for _, cs := range cond.GetStartWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.HasPrefix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
+		for _, cs := range m.operands {
+			if strings.HasPrefix(str, cs) {
 				return true
 			}
 		}
 		return false
-
 	case "end_with":
 		if !has {
 			return false
 		}
-		for _, cs := range cond.GetEndWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.HasSuffix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
+		for _, cs := range m.operands {
+			if strings.HasSuffix(str, cs) {
 				return true
 			}
 		}
@@ -154,15 +537,8 @@ func EvaluateText(has bool, str string, cond *header.TextCondition) bool {
 		if !has {
 			return false
 		}
-		for _, cs := range cond.GetContain() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.Contains(strings.TrimSpace(str), strings.TrimSpace(cs)) {
+		for _, cs := range m.operands {
+			if strings.Contains(str, cs) {
 				return true
 			}
 		}
@@ -171,15 +547,8 @@ func EvaluateText(has bool, str string, cond *header.TextCondition) bool {
 		if !has {
 			return false
 		}
-		for _, cs := range cond.GetNotContain() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.Contains(strings.TrimSpace(str), strings.TrimSpace(cs)) {
+		for _, cs := range m.operands {
+			if strings.Contains(str, cs) {
 				return false
 			}
 		}
@@ -188,15 +557,8 @@ func EvaluateText(has bool, str string, cond *header.TextCondition) bool {
 		if !has {
 			return false
 		}
-		for _, cs := range cond.GetNotStartWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.HasPrefix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
+		for _, cs := range m.operands {
+			if strings.HasPrefix(str, cs) {
 				return false
 			}
 		}
@@ -205,15 +567,8 @@ func EvaluateText(has bool, str string, cond *header.TextCondition) bool {
 		if !has {
 			return false
 		}
-		for _, cs := range cond.GetEndWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-
-			if strings.HasSuffix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
+		for _, cs := range m.operands {
+			if strings.HasSuffix(str, cs) {
 				return false
 			}
 		}
@@ -221,178 +576,149 @@ func EvaluateText(has bool, str string, cond *header.TextCondition) bool {
 	default:
 		return true
 	}
-
-	return true
 }
 
-func EvaluateTexts(strs []string, cond *header.TextCondition) bool {
-	if len(cond.GetTransforms()) > 0 {
-		for i, str := range strs {
-			strs[i] = applyTextTransform(str, cond.GetTransforms())
-		}
-	}
-
-	if !cond.GetCaseSensitive() {
-		for i, str := range strs {
-			strs[i] = strings.ToLower(str)
-		}
-	}
-	if !cond.GetAccentSensitive() {
-		for i, str := range strs {
-			strs[i] = ascii.Convert(str)
+// matchAll evaluates a multi-valued field. Without quantifier, positive ops
+// match when any value matches and negated ops when every value does. With
+// a quantifier the op is tested against each value then:
+//
+//	any/op: at least one value matches
+//	none/op: no value matches
+//	all/op: every operand is matched by some value, e.g: all/eq VIP,Paid, or
+//	  when the op has no operand or is negated, e.g: all/has_value,
+//	  all/neq, every value matches
+//	exactly:N/op, at_least:N/op: N values, at least N values match
+func (m *textMatcher) matchAll(strs []string) bool {
+	vals := m.normalizeAll(strs)
+	if setTextOps[m.op] {
+		return m.matchSet(vals)
+	}
+
+	switch m.quantifier {
+	case "any":
+		return m.countMatches(vals) > 0
+	case "none":
+		return m.countMatches(vals) == 0
+	case "all":
+		if len(m.each) > 0 {
+			for _, each := range m.each {
+				if each.countMatches(vals) == 0 {
+					return false
+				}
+			}
+			return true
 		}
+		return len(vals) > 0 && m.countMatches(vals) == len(vals)
+	case "exactly":
+		return int64(m.countMatches(vals)) == m.count
+	case "at_least":
+		return int64(m.countMatches(vals)) >= m.count
 	}
 
-	switch cond.GetOp() {
-	case "any":
-		return true
+	switch m.op {
 	case "has_value":
-		return len(strs) == 0
+		return len(vals) > 0
 	case "is_empty":
-		return len(strs) == 0
-	case "eq":
-		if len(cond.GetEq()) == 0 {
-			return true
-		}
-		for _, cs := range cond.GetEq() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-			for _, str := range strs {
-
-				if strings.TrimSpace(str) == strings.TrimSpace(cs) {
-					return true
-				}
-			}
-		}
-		return false
-	case "neq":
-		if len(cond.GetNeq()) == 0 {
+		return len(vals) == 0
+	case "eq", "neq":
+		if len(m.operands) == 0 {
 			return true
 		}
+	}
 
-		for _, cs := range cond.GetNeq() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-			for _, str := range strs {
-				if strings.TrimSpace(str) == strings.TrimSpace(cs) {
-					return false
-				}
-			}
-		}
+	if !hasOp(textOps, m.op) || m.op == "any" {
 		return true
-	case "regex":
-		for _, str := range strs {
-			if b, _ := regexp.MatchString(cond.GetRegex(), str); b {
-				return true
-			}
-			return false
-		}
-	case "start_with":
-		for _, cs := range cond.GetStartWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-			for _, str := range strs {
-				if strings.HasPrefix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
-					return true
-				}
-			}
-		}
-		return false
+	}
 
-	case "end_with":
-		for _, cs := range cond.GetEndWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
+	if negatedTextOps[m.op] {
+		return m.countMatches(vals) == len(vals)
+	}
+	return m.countMatches(vals) > 0
+}
 
-			for _, str := range strs {
-				if strings.HasSuffix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
-					return true
-				}
-			}
+// matchAny evaluates the values one by one: strs match when any value
+// does, or when there is none and the missing value does
+func (m *textMatcher) matchAny(strs []string) bool {
+	if len(strs) == 0 {
+		return m.test(false, m.normalize(""))
+	}
+	for _, str := range strs {
+		if m.test(true, m.normalize(str)) {
+			return true
 		}
-		return false
-	case "contain":
-		for _, cs := range cond.GetContain() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-			for _, str := range strs {
-				if strings.Contains(strings.TrimSpace(str), strings.TrimSpace(cs)) {
-					return true
-				}
+	}
+	return false
+}
+
+// matchSet compares the normalized values as a set with the operands
+func (m *textMatcher) matchSet(vals []string) bool {
+	switch m.op {
+	case "contains_any":
+		for _, str := range vals {
+			if m.isOperand(str) {
+				return true
 			}
 		}
 		return false
-	case "not_contain":
-		for _, cs := range cond.GetNotContain() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-			for _, str := range strs {
-				if strings.Contains(strings.TrimSpace(str), strings.TrimSpace(cs)) {
-					return false
-				}
+	case "contains_none":
+		for _, str := range vals {
+			if m.isOperand(str) {
+				return false
 			}
 		}
 		return true
-	case "not_start_with":
-		for _, cs := range cond.GetNotStartWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-			for _, str := range strs {
-				if strings.HasPrefix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
+	case "contains_all", "subset_of", "equals_set":
+		found := map[string]bool{}
+		for _, str := range vals {
+			if !m.isOperand(str) {
+				if m.op != "contains_all" {
 					return false
 				}
+				continue
 			}
+			found[str] = true
 		}
-		return true
-	case "not_end_with":
+		if m.op == "subset_of" {
+			return true
+		}
+		return len(found) == len(m.set)
+	case "size_eq":
+		return int64(len(vals)) == m.length
+	case "size_gt":
+		return int64(len(vals)) > m.length
+	case "size_lt":
+		return int64(len(vals)) < m.length
+	}
+	return false
+}
 
-		for _, cs := range cond.GetEndWith() {
-			if !cond.GetCaseSensitive() {
-				cs = strings.ToLower(cs)
-			}
-			if !cond.GetAccentSensitive() {
-				cs = ascii.Convert(cs)
-			}
-			for _, str := range strs {
-				if strings.HasSuffix(strings.TrimSpace(str), strings.TrimSpace(cs)) {
-					return false
-				}
-			}
+// countMatches returns the number of normalized values satisfying the op
+func (m *textMatcher) countMatches(vals []string) int {
+	n := 0
+	for _, str := range vals {
+		if m.test(true, str) {
+			n++
 		}
-		return true
-	default:
-		return true
 	}
+	return n
+}
 
-	return true
+// EvaluateText tells whether str satisfies cond, a condition with an invalid
+// regex never matches, use Compile or ValidateCondition to get the error
+func EvaluateText(has bool, str string, cond *header.TextCondition) bool {
+	m, err := newTextMatcher(cond)
+	if err != nil {
+		return false
+	}
+	return m.match(has, str)
+}
+
+func EvaluateTexts(strs []string, cond *header.TextCondition) bool {
+	m, err := newTextMatcher(cond)
+	if err != nil {
+		return false
+	}
+	return m.matchAll(strs)
 }
 
 func EvaluateFloat(found bool, fl float64, cond *header.FloatCondition) bool {
@@ -431,6 +757,8 @@ func EvaluateFloat(found bool, fl float64, cond *header.FloatCondition) bool {
 	case "gt":
 		return fl > cond.GetGt()
 	case "lt":
+		// lt including its bound and gte reading lte are kept as stored
+		// conditions rely on them, ToSQLAt translates them the same way
 		return fl <= cond.GetLt()
 	case "gte":
 		return fl >= cond.GetLte() || math.Abs(fl-cond.GetGte()) < Tolerance
@@ -464,10 +792,41 @@ func EvaluateBool(found, boo bool, cond *header.BoolCondition) bool {
 	return true
 }
 
+// EvalContext holds the environment a condition is evaluated in. Now is the
+// moment relative datetime ops (today, last, before_ago, ...) are computed
+// from, a zero Now means the current time.
+// Calendar ops (today, this_week, ...) are computed in Location, when nil the
+// account timezone is used, either an offset (+07:00) or an IANA name
+// (Asia/Ho_Chi_Minh). Weeks start on WeekStart, an english weekday name
+// (e.g: sunday) or number (0 is Sunday), Monday when unset: callers read it
+// from the account settings. Fiscal years likewise start on
+// FiscalYearStartMonth, January when unset
+type EvalContext struct {
+	Now                  time.Time
+	Location             *time.Location
+	WeekStart            string
+	FiscalYearStartMonth time.Month
+}
+
+func (ctx *EvalContext) now() time.Time {
+	if ctx == nil || ctx.Now.IsZero() {
+		return time.Now()
+	}
+	return ctx.Now
+}
+
 func EvaluateDatetime(acc *apb.Account, found bool, accid string, unixms int64, cond *header.DatetimeCondition) bool {
-	t := time.Unix(unixms/1000, 0)
+	return EvaluateDatetimeAt(&EvalContext{Now: time.Now()}, acc, found, unixms, cond)
+}
 
-	switch cond.GetOp() {
+// EvaluateDatetimeAt is EvaluateDatetime evaluated as of ctx.Now
+func EvaluateDatetimeAt(ctx *EvalContext, acc *apb.Account, found bool, unixms int64, cond *header.DatetimeCondition) bool {
+	loc := ctx.location(acc)
+	t := time.Unix(unixms/1000, 0).In(loc)
+	now := ctx.now().In(loc)
+
+	op, args := splitOp(cond.GetOp())
+	switch op {
 	case "any":
 		return true
 	case "unset":
@@ -476,114 +835,163 @@ func EvaluateDatetime(acc *apb.Account, found bool, accid string, unixms int64,
 		return found
 	// apply transform first
 	case "in_business_hour":
-		inbusinesshours, _ := business_hours.DuringBusinessHour(acc.GetBusinessHours(), t, acc.GetTimezone())
+		inbusinesshours, _ := business_hours.DuringBusinessHour(acc.GetBusinessHours(), t, tzOffset(t))
 		return inbusinesshours
 	case "non_business_hour":
-		inbusinesshours, _ := business_hours.DuringBusinessHour(acc.GetBusinessHours(), t, acc.GetTimezone())
+		inbusinesshours, _ := business_hours.DuringBusinessHour(acc.GetBusinessHours(), t, tzOffset(t))
 		return !inbusinesshours
-	case "today":
-		utc := time.Now().UTC()
-		startoftheday := time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, utc.Location())
-		endoftheday := time.Date(utc.Year(), utc.Month(), utc.Day(), 23, 59, 59, 0, utc.Location())
-		h, m, _ := business_hours.SplitTzOffset(acc.GetTimezone())
-		tzsec := int64(h*3600 + m*60)
-		if startoftheday.Unix()+tzsec <= t.Unix() && t.Unix() <= endoftheday.Unix()+tzsec {
-			return true
+	case "time_of_day":
+		if !found || len(args) != 2 {
+			return false
 		}
-		return false
+		from, ok1 := parseClock(args[0])
+		to, ok2 := parseClock(args[1])
+		if !ok1 || !ok2 {
+			return false
+		}
+		min := t.Hour()*60 + t.Minute()
+		if from <= to {
+			return from <= min && min <= to
+		}
+		// window crosses midnight, e.g: 22:00 to 06:00
+		return from <= min || min <= to
+	case "business_hours_last":
+		sec, ok := intArg(args)
+		if !found || !ok || t.After(now) {
+			return false
+		}
+		return businessSeconds(acc.GetBusinessHours(), t, now, sec) <= sec
+	case "business_hours_before_ago":
+		sec, ok := intArg(args)
+		if !found || !ok || t.After(now) {
+			return false
+		}
+		return businessSeconds(acc.GetBusinessHours(), t, now, sec) > sec
+	case "today":
+		start := startOfDay(now)
+		return inPeriod(t, start, start.AddDate(0, 0, 1))
 	case "date_last_30mins":
-		now := time.Now().Unix()
-		last30mins := now - 1800
-		return last30mins <= t.Unix() && t.Unix() <= now
+		nowsec := now.Unix()
+		last30mins := nowsec - 1800
+		return last30mins <= t.Unix() && t.Unix() <= nowsec
 	case "date_last_2hours":
-		now := time.Now().Unix()
-		last2hours := now - 7200
-		return last2hours <= t.Unix() && t.Unix() <= now
+		nowsec := now.Unix()
+		last2hours := nowsec - 7200
+		return last2hours <= t.Unix() && t.Unix() <= nowsec
 	case "date_last_24h":
-		now := time.Now().Unix()
-		last1days := now - 86400
-		return last1days <= t.Unix() && t.Unix() <= now
+		nowsec := now.Unix()
+		last1days := nowsec - 86400
+		return last1days <= t.Unix() && t.Unix() <= nowsec
 	case "date_last_7days":
-		now := time.Now().Unix()
-		last7days := now - 7*86400
-		return last7days <= t.Unix() && t.Unix() <= now
+		nowsec := now.Unix()
+		last7days := nowsec - 7*86400
+		return last7days <= t.Unix() && t.Unix() <= nowsec
 	case "date_last_30days":
-		now := time.Now().Unix()
-		last30days := now - 30*86400
-		return last30days <= t.Unix() && t.Unix() <= now
+		nowsec := now.Unix()
+		last30days := nowsec - 30*86400
+		return last30days <= t.Unix() && t.Unix() <= nowsec
 	case "yesterday":
-		utc := time.Now().UTC()
-		startoftheday := time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, utc.Location()).Unix()
-		startofyesterday := startoftheday - 86400
-
-		h, m, _ := business_hours.SplitTzOffset(acc.GetTimezone())
-		tzsec := int64(h*3600 + m*60)
-		return startofyesterday+tzsec <= t.Unix() && t.Unix() <= startoftheday+tzsec
+		end := startOfDay(now)
+		return inPeriod(t, end.AddDate(0, 0, -1), end)
 	case "last_week":
-		utc := time.Now().UTC()
-		startoftheday := time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, utc.Location())
-		weekday := int64(startoftheday.Weekday())
-		weekday--
-		if weekday == -1 {
-			weekday = 7
-		}
-		startoftheweek := time.Unix(startoftheday.Unix()-weekday*86400, 0)
-		endoftheweek := time.Unix(startoftheday.Unix()*(7-weekday)*86400+86400, 0)
-		// endoftheday := time.Date(utc.Year(), utc.Month(), utc.Day(), 23, 59, 59, 0, utc.Location())
-
-		h, m, _ := business_hours.SplitTzOffset(acc.GetTimezone())
-		tzsec := int64(h*3600 + m*60)
-		if startoftheweek.Unix()-604800+tzsec <= t.Unix() && t.Unix() <= endoftheweek.Unix()-604800+tzsec { // 604800 is to move back 7 day
-			return true
-		}
-		return false
+		end := startOfWeek(now, ctx.weekStart())
+		return inPeriod(t, end.AddDate(0, 0, -7), end)
 	case "this_week":
-		utc := time.Now().UTC()
-		startoftheday := time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, utc.Location())
-		weekday := int64(startoftheday.Weekday())
-		weekday--
-		if weekday == -1 {
-			weekday = 7
-		}
-		startoftheweek := time.Unix(startoftheday.Unix()-weekday*86400, 0)
-		endoftheweek := time.Unix(startoftheday.Unix()*(7-weekday)*86400+86400, 0)
-		// endoftheday := time.Date(utc.Year(), utc.Month(), utc.Day(), 23, 59, 59, 0, utc.Location())
-
-		h, m, _ := business_hours.SplitTzOffset(acc.GetTimezone())
-		tzsec := int64(h*3600 + m*60)
-		if startoftheweek.Unix()+tzsec <= t.Unix() && t.Unix() <= endoftheweek.Unix()+tzsec { // 604800 is to move back 7 day
-			return true
-		}
-		return false
+		start := startOfWeek(now, ctx.weekStart())
+		return inPeriod(t, start, start.AddDate(0, 0, 7))
 	case "last_month":
-		utc := time.Now().UTC()
-		endOfMonth := time.Date(utc.Year(), utc.Month(), 1, 0, 0, 0, 0, utc.Location())
-		endOfMonth = endOfMonth.AddDate(0, 0, -1)
-
-		startOfMonth := time.Date(endOfMonth.Year(), endOfMonth.Month(), 1, 0, 0, 0, 0, utc.Location())
-		h, m, _ := business_hours.SplitTzOffset(acc.GetTimezone())
-		tzsec := int64(h*3600 + m*60)
-		if startOfMonth.Unix()+tzsec <= t.Unix() && t.Unix() <= endOfMonth.Unix()+tzsec {
-			return true
-		}
-		return false
+		end := startOfMonth(now)
+		return inPeriod(t, end.AddDate(0, -1, 0), end)
 	case "this_month":
-		utc := time.Now().UTC()
-		firstOfMonth := time.Date(utc.Year(), utc.Month(), 1, 0, 0, 0, 0, utc.Location())
-		lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
-
-		h, m, _ := business_hours.SplitTzOffset(acc.GetTimezone())
-		tzsec := int64(h*3600 + m*60)
-		if firstOfMonth.Unix()+tzsec <= t.Unix() && t.Unix() <= lastOfMonth.Unix()+tzsec {
-			return true
+		start := startOfMonth(now)
+		return inPeriod(t, start, start.AddDate(0, 1, 0))
+	case "this_quarter":
+		start := startOfQuarter(now, time.January)
+		return inPeriod(t, start, start.AddDate(0, 3, 0))
+	case "last_quarter":
+		end := startOfQuarter(now, time.January)
+		return inPeriod(t, end.AddDate(0, -3, 0), end)
+	case "this_year":
+		start := startOfYear(now, time.January)
+		return inPeriod(t, start, start.AddDate(1, 0, 0))
+	case "last_year":
+		end := startOfYear(now, time.January)
+		return inPeriod(t, end.AddDate(-1, 0, 0), end)
+	case "this_fiscal_quarter":
+		start := startOfQuarter(now, ctx.fiscalYearStart())
+		return inPeriod(t, start, start.AddDate(0, 3, 0))
+	case "last_fiscal_quarter":
+		end := startOfQuarter(now, ctx.fiscalYearStart())
+		return inPeriod(t, end.AddDate(0, -3, 0), end)
+	case "this_fiscal_year":
+		start := startOfYear(now, ctx.fiscalYearStart())
+		return inPeriod(t, start, start.AddDate(1, 0, 0))
+	case "last_fiscal_year":
+		end := startOfYear(now, ctx.fiscalYearStart())
+		return inPeriod(t, end.AddDate(-1, 0, 0), end)
+	case "tomorrow":
+		start := startOfDay(now).AddDate(0, 0, 1)
+		return inPeriod(t, start, start.AddDate(0, 0, 1))
+	case "next_week":
+		start := startOfWeek(now, ctx.weekStart()).AddDate(0, 0, 7)
+		return inPeriod(t, start, start.AddDate(0, 0, 7))
+	case "next_month":
+		start := startOfMonth(now).AddDate(0, 1, 0)
+		return inPeriod(t, start, start.AddDate(0, 1, 0))
+	case "next":
+		sec, ok := intArg(args)
+		if !ok {
+			return false
 		}
-		return false
+		return now.Unix() <= t.Unix() && t.Unix() <= now.Unix()+sec
+	case "after_from_now":
+		sec, ok := intArg(args)
+		if !ok {
+			return false
+		}
+		return t.Unix() > now.Unix()+sec
 	case "last":
-		a := time.Now().Unix() - cond.GetLast()
-		b := time.Now().Unix()
+		a := now.Unix() - cond.GetLast()
+		b := now.Unix()
 		return a <= t.Unix() && t.Unix() <= b
 	case "before_ago":
-		return t.Unix() < time.Now().Unix()-cond.GetBeforeAgo()
+		return t.Unix() < now.Unix()-cond.GetBeforeAgo()
+	case "anniversary_today":
+		if !found {
+			return false
+		}
+		return sameDay(anniversary(t, now.Year()), now)
+	case "anniversary_in_next":
+		days, ok := intArg(args)
+		if !found || !ok {
+			return false
+		}
+		today := startOfDay(now)
+		next := anniversary(t, now.Year())
+		if next.Before(today) {
+			next = anniversary(t, now.Year()+1)
+		}
+		return int64(daysBetween(today, next)) <= days
+	case "month_is":
+		if !found {
+			return false
+		}
+		for _, arg := range args {
+			if month, ok := parseMonth(arg); ok && month == t.Month() {
+				return true
+			}
+		}
+		return false
+	case "day_of_month_is":
+		if !found {
+			return false
+		}
+		for _, arg := range args {
+			if day, err := strconv.Atoi(strings.TrimSpace(arg)); err == nil && day == t.Day() {
+				return true
+			}
+		}
+		return false
 	case "days_of_week":
 		for _, weekday := range cond.GetDaysOfWeek() {
 			if strings.EqualFold(weekday, t.Weekday().String()) {
@@ -613,260 +1021,69 @@ func EvaluateDatetime(acc *apb.Account, found bool, accid string, unixms int64,
 	return true
 }
 
-func RsCheck(acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User, cond *header.UserViewCondition, deleted bool) bool {
-	if len(cond.GetOne()) > 0 {
-		for _, c := range cond.GetOne() {
-			if RsCheck(acc, defM, u, c, deleted) {
-				return true
-			}
+// FindAttr returns the text, number, datetime (unix milliseconds) and boolean
+// values of attribute key. Datetime attributes holding no valid RFC3339 date
+// are not found
+func FindAttr(u *header.User, key string, typ string) (string, float64, int64, bool, bool) {
+	for _, a := range u.Attributes {
+		if a.Key != key {
+			continue
 		}
-		return false
-	}
-
-	if len(cond.GetAll()) > 0 {
-		for _, c := range cond.GetAll() {
-			if !RsCheck(acc, defM, u, c, deleted) {
-				return false
+		t, err := time.Parse(time.RFC3339, a.GetDatetime())
+		if err != nil {
+			if typ == "datetime" {
+				return "", 0, 0, false, false
 			}
+			t = time.Unix(0, 0)
 		}
-		return true
-	}
-	return evaluateSingleCond(acc, defM, u, cond, deleted)
-}
 
-func evaluateSingleCond(acc *apb.Account, defM map[string]*header.AttributeDefinition, u *header.User, cond *header.UserViewCondition, deleted bool) bool {
-	if deleted && u.Deleted == 0 {
-		return false
-	}
-
-	if !deleted && u.Deleted > 0 {
-		return false
-	}
-
-	accid := u.GetAccountId()
-	if cond.GetKey() == "id" {
-		id := u.GetId()
-		return EvaluateText(true, id, cond.GetText())
-	}
-
-	if cond.GetKey() == "channel" {
-		return EvaluateText(true, u.Channel, cond.GetText())
+		text := a.Text
+		return text, a.Number, t.UnixMilli(), a.Boolean, true
 	}
+	return "", 0, 0, false, false
+}
 
-	if cond.GetKey() == "channel_source" {
-		return EvaluateText(true, u.ChannelSource, cond.GetText())
+// FindListAttr returns the values of list attribute key, stored either as a
+// JSON array (["a","b"]) or as comma-separated text (a, b). Empty values are
+// dropped
+func FindListAttr(u *header.User, key string) ([]string, bool) {
+	text, _, _, _, found := FindAttr(u, key, "list")
+	if !found {
+		return nil, false
 	}
+	return decodeList(text), true
+}
 
-	if cond.GetKey() == "keyword" && len(cond.GetText().GetContain()) > 0 { // email phone or name
-		// remove space
-		keyword := ascii.Convert(SpaceStringsBuilder(strings.ToLower(cond.GetText().GetContain()[0])))
-
-		for _, attr := range u.Attributes {
-			if attr.Text != "" {
-				if strings.Contains(ascii.Convert(strings.ToLower(SpaceStringsBuilder(attr.Text))), keyword) {
-					return true
+func decodeList(text string) []string {
+	vals := []string{}
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "[") {
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.UseNumber()
+		var items []interface{}
+		if err := dec.Decode(&items); err == nil {
+			for _, item := range items {
+				if item == nil {
+					continue
+				}
+				val, ok := item.(string)
+				if !ok {
+					val = fmt.Sprint(item)
+				}
+				if val = strings.TrimSpace(val); val != "" {
+					vals = append(vals, val)
 				}
 			}
+			return vals
 		}
-
-		return strings.Contains(strings.TrimSpace(strings.ToLower(u.Id)), keyword)
-	}
-
-	if cond.GetKey() == "lead_owners" {
-		for _, owner := range u.GetLeadOwners() {
-			if EvaluateText(true, owner, cond.GetText()) {
-				return true
-			}
-		}
-
-		if len(u.GetLeadOwners()) == 0 {
-			if EvaluateText(false, "", cond.Text) {
-				return true
-			}
-		}
-		return false
-	}
-
-	if cond.GetKey() == "lead_conversion_bys" {
-		for _, by := range u.GetLeadConversionBys() {
-			if EvaluateText(true, by, cond.GetText()) {
-				return true
-			}
-		}
-
-		if len(u.GetLeadConversionBys()) == 0 {
-			if EvaluateText(false, "", cond.Text) {
-				return true
-			}
-		}
-		return false
-	}
-
-	if cond.GetKey() == "start_content_view:by:device:ip" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetIp(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:language" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetLanguage(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:page_title" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetPageTitle(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:page_url" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetPageUrl(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:platform" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetPlatform(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:referrer" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetReferrer(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:screen_resolution" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetScreenResolution(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:source" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetSource(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:type" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetType(), cond.Text)
-	}
-	if cond.GetKey() == "start_content_view:by:device:user_agent" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUserAgent(), cond.Text)
-	}
-
-	if cond.GetKey() == "start_content_view:by:device:utm:name" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetName(), cond.Text)
-	}
-
-	if cond.GetKey() == "start_content_view:by:device:utm:source" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetSource(), cond.Text)
-	}
-
-	if cond.GetKey() == "start_content_view:by:device:utm:medium" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetMedium(), cond.Text)
-	}
-
-	if cond.GetKey() == "start_content_view:by:device:utm:term" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetTerm(), cond.Text)
-	}
-
-	if cond.GetKey() == "start_content_view:by:device:utm:content" {
-		return EvaluateText(u.StartContentView != nil, u.GetStartContentView().GetBy().GetDevice().GetUtm().GetContent(), cond.Text)
-	}
-
-	if cond.GetKey() == "first_content_view:by:device:ip" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetIp(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:language" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetLanguage(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:page_title" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetPageTitle(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:page_url" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetPageUrl(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:platform" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetPlatform(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:referrer" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetReferrer(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:screen_resolution" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetScreenResolution(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:source" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetSource(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:type" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetType(), cond.Text)
-	}
-	if cond.GetKey() == "first_content_view:by:device:user_agent" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUserAgent(), cond.Text)
-	}
-
-	if cond.GetKey() == "first_content_view:by:device:utm:name" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetName(), cond.Text)
-	}
-
-	if cond.GetKey() == "first_content_view:by:device:utm:source" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetSource(), cond.Text)
-	}
-
-	if cond.GetKey() == "first_content_view:by:device:utm:medium" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetMedium(), cond.Text)
-	}
-
-	if cond.GetKey() == "first_content_view:by:device:utm:term" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetTerm(), cond.Text)
-	}
-
-	if cond.GetKey() == "first_content_view:by:device:utm:content" {
-		return EvaluateText(u.FirstContentView != nil, u.GetFirstContentView().GetBy().GetDevice().GetUtm().GetContent(), cond.Text)
-	}
-
-	if cond.GetKey() == "labels" {
-		labels := []string{}
-		for _, label := range u.Labels {
-			labels = append(labels, label.Label)
-		}
-
-		return EvaluateTexts(labels, cond.Text)
-	}
-
-	if cond.GetKey() == "segment" {
-		segs := []string{}
-		for _, seg := range u.Segments {
-			segs = append(segs, seg.GetSegmentId())
-		}
-		return EvaluateTexts(segs, cond.Text)
 	}
 
-	if strings.HasPrefix(cond.GetKey(), "attr:") || strings.HasPrefix(cond.GetKey(), "attr.") {
-		key := cond.GetKey()[5:]
-
-		def := defM[key]
-		if def == nil {
-			// def not found
-			return false
-		}
-
-		defType := def.GetType()
-
-		if defType == "list" || defType == "" {
-			defType = "text"
-		}
-		text, num, date, boo, found := FindAttr(u, key, def.Type)
-		if defType == "text" {
-			return EvaluateText(found, text, cond.GetText())
-		}
-
-		if defType == "number" {
-			return EvaluateFloat(found, num, cond.GetNumber())
-		}
-		if defType == "boolean" {
-			return EvaluateBool(found, boo, cond.GetBoolean())
+	for _, val := range strings.Split(text, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			vals = append(vals, val)
 		}
-		if defType == "datetime" { // consider number in ms
-			return EvaluateDatetime(acc, found, accid, date, cond.Datetime)
-		}
-	}
-	return true
-}
-
-func FindAttr(u *header.User, key string, typ string) (string, float64, int64, bool, bool) {
-	for _, a := range u.Attributes {
-		if a.Key != key {
-			continue
-		}
-		t, err := time.Parse(time.RFC3339, a.GetDatetime())
-		if err != nil {
-			t = time.Unix(0, 0)
-		}
-
-		text := a.Text
-		return text, a.Number, t.UnixMilli(), a.Boolean, true
 	}
-	return "", 0, 0, false, false
+	return vals
 }
 
 func SpaceStringsBuilder(str string) string {
@@ -880,7 +1097,28 @@ func SpaceStringsBuilder(str string) string {
 	return b.String()
 }
 
+// PureFilterUsers returns the page of leads matching cond. A condition which
+// fails to compile matches no lead, the error is logged, use
+// PureFilterUsersAt to get it
 func PureFilterUsers(acc *apb.Account, cond *header.UserViewCondition, leads []*header.User, anchor string, limit int, orderby string, defM map[string]*header.AttributeDefinition, ignoreIds map[string]bool) *header.Users {
+	users, err := PureFilterUsersAt(&EvalContext{Now: time.Now()}, acc, cond, leads, anchor, limit, orderby, defM, ignoreIds)
+	if err != nil {
+		log.Err(acc.GetId(), err, "invalid user view condition")
+		return &header.Users{Anchor: anchor}
+	}
+	return users
+}
+
+// PureFilterUsersAt is PureFilterUsers evaluated as of ctx.Now, every lead
+// in the scan sees the same moment. A condition which fails to compile is
+// returned as error
+func PureFilterUsersAt(ctx *EvalContext, acc *apb.Account, cond *header.UserViewCondition, leads []*header.User, anchor string, limit int, orderby string, defM map[string]*header.AttributeDefinition, ignoreIds map[string]bool) (*header.Users, error) {
+	frozen := EvalContext{}
+	if ctx != nil {
+		frozen = *ctx
+	}
+	frozen.Now = ctx.now()
+	ctx = &frozen
 	if cond == nil {
 		cond = &header.UserViewCondition{}
 	}
@@ -910,12 +1148,11 @@ func PureFilterUsers(acc *apb.Account, cond *header.UserViewCondition, leads []*
 	}
 
 	// segment
-	segmentid := ""
-	for _, cond := range cond.GetAll() {
-		if cond.GetKey() == "segment" && cond.GetText().GetOp() == "eq" && len(cond.GetText().GetEq()) > 0 {
-			segmentid = cond.GetText().GetEq()[0]
-			break
-		}
+	segmentid := conditionSegmentId(cond)
+
+	compiled, err := Compile(acc, defM, cond)
+	if err != nil {
+		return nil, err
 	}
 
 	total := 0
@@ -925,7 +1162,7 @@ func PureFilterUsers(acc *apb.Account, cond *header.UserViewCondition, leads []*
 			return
 		}
 
-		if !RsCheck(acc, defM, u, cond, cond.Deleted) {
+		if !compiled.MatchAt(ctx, u) {
 			return
 		}
 
@@ -974,7 +1211,7 @@ func PureFilterUsers(acc *apb.Account, cond *header.UserViewCondition, leads []*
 		lastUserId := res[len(res)-1].Id
 		anchor = valM[lastUserId] + "." + lastUserId
 	}
-	return &header.Users{Users: res, Hit: int64(len(res)), Total: int64(total), Anchor: anchor}
+	return &header.Users{Users: res, Hit: int64(len(res)), Total: int64(total), Anchor: anchor}, nil
 }
 
 func MergeUserResult(dst, src *header.Users, limit int, segmentid, orderby string, defM map[string]*header.AttributeDefinition) *header.Users {
@@ -1087,6 +1324,20 @@ func LessVal(iid, jid string, valM map[string]string, desc bool) bool {
 	return less
 }
 
+// conditionSegmentId returns the segment a condition requires, used to sort
+// by segment join time. Segments inside a negation are not required
+func conditionSegmentId(cond *header.UserViewCondition) string {
+	if cond.GetKey() == NotKey {
+		return ""
+	}
+	for _, cond := range cond.GetAll() {
+		if cond.GetKey() == "segment" && cond.GetText().GetOp() == "eq" && len(cond.GetText().GetEq()) > 0 {
+			return cond.GetText().GetEq()[0]
+		}
+	}
+	return ""
+}
+
 func GetSortValSegmentId(segmentid string, user *header.User) string {
 	if segmentid == "" {
 		return "f" + user.Id
@@ -1101,6 +1352,8 @@ func GetSortValSegmentId(segmentid string, user *header.User) string {
 	return "f0"
 }
 
+// GetSortVal returns the value users are sorted by, any key resolvable by
+// ResolveKey is sortable
 func GetSortVal(orderby string, user *header.User, defM map[string]*header.AttributeDefinition) string {
 	if orderby == "" {
 		orderby = "id"
@@ -1109,45 +1362,33 @@ func GetSortVal(orderby string, user *header.User, defM map[string]*header.Attri
 		orderby = orderby[1:]
 	}
 
-	var val = "s"
-	if orderby == "id" {
-		val = "s" + user.Id
-	}
-	if orderby == "lead_owners" {
-		val = "l" + strconv.Itoa(len(user.LeadOwners)) + "." + strings.Join(user.LeadOwners, ",")
-	}
-	if orderby == "labels" {
-		val = ""
-		for _, l := range user.Labels {
-			val += l.Label
-		}
-		val = "l" + strconv.Itoa(len(user.Labels)) + "." + val
+	accessor, err := ResolveKey(orderby, defM)
+	if err != nil {
+		return "s"
 	}
 
-	if strings.HasPrefix(orderby, "attr:") || strings.HasPrefix(orderby, "attr.") {
-		key := orderby[5:]
-		def := defM[key]
-		if def != nil {
-			text, num, date, boo, _ := FindAttr(user, key, def.Type)
-			if def.Type == "text" || def.Type == "" || def.Type == "list" {
-				val = "s" + text
-			}
-			if def.Type == "number" {
-				val = "f" + strconv.FormatFloat(num, 'E', -1, 64)
-			}
-			if def.Type == "boolean" {
-				if !boo {
-					val = "s0."
-				} else {
-					val = "s1."
-				}
-			}
-			if def.Type == "datetime" { // consider number in ms
-				val = "s" + time.Unix(date/1000, 0).Format(time.RFC3339)
-			}
+	v := accessor.Get(user)
+	switch accessor.Type {
+	case "text":
+		return "s" + v.Text
+	case "list":
+		// labels have always been sorted by their concatenation
+		sep := ","
+		if orderby == "labels" {
+			sep = ""
+		}
+		return "l" + strconv.Itoa(len(v.List)) + "." + strings.Join(v.List, sep)
+	case "number":
+		return "f" + strconv.FormatFloat(v.Number, 'E', -1, 64)
+	case "boolean":
+		if !v.Boolean {
+			return "s0."
 		}
+		return "s1."
+	case "datetime": // consider number in ms
+		return "s" + time.Unix(v.Datetime/1000, 0).Format(time.RFC3339)
 	}
-	return val
+	return "s"
 }
 
 const UserQueryURL = "https://user-query-66xno24cra-as.a.run.app"
@@ -1167,13 +1408,7 @@ func DoFilter(version int, acc *apb.Account, cond *header.UserViewCondition, def
 	wg.Add(NPartition)
 	var outerr = make([]error, NPartition)
 
-	segmentid := ""
-	for _, cond := range cond.GetAll() {
-		if cond.GetKey() == "segment" && cond.GetText().GetOp() == "eq" && len(cond.GetText().GetEq()) > 0 {
-			segmentid = cond.GetText().GetEq()[0]
-			break
-		}
-	}
+	segmentid := conditionSegmentId(cond)
 
 	for i := 0; i < NPartition; i++ {
 		go func(i int) {
@@ -1265,12 +1500,7 @@ func DoFilterBatch(version int, acc *apb.Account, conds []*header.UserViewCondit
 			for i, users := range userss {
 				segmentid := ""
 				if len(conds) > i {
-					for _, cond := range conds[i].GetAll() {
-						if cond.GetKey() == "segment" && cond.GetText().GetOp() == "eq" && len(cond.GetText().GetEq()) > 0 {
-							segmentid = cond.GetText().GetEq()[0]
-							break
-						}
-					}
+					segmentid = conditionSegmentId(conds[i])
 				}
 				res[i] = MergeUserResult(res[i], users, limit, segmentid, orderbys[i], defM)
 			}
@@ -0,0 +1,404 @@
+package userutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/subiz/header"
+)
+
+// The op and transform grammar, each table below maps a name to the
+// arguments it takes. Arguments follow the name after a colon and are comma
+// separated, e.g: month_is:1,2. Text ops may be prefixed by a quantifier and
+// a slash, e.g: all/eq, exactly:2/contain, see matchAll:
+//
+//	quantifier  any | all | none | exactly:N | at_least:N
+//	N           a non-negative integer, a count, a length or seconds
+//	int         an integer, negative counts from the end
+//	ratio       a number in (0, 1]
+//	number      a decimal number
+//	clock       a time of day, 00:00 to 23:59
+//	month       1 to 12 or an english month name, e.g: jan, March
+//	day         a day of month, 1 to 31
+//	text        any text, commas included
+//
+// Names listed without arguments take none. Compare ops, e.g:
+// compare:gt,attr:budget, are described in compare.go
+type opGrammar struct {
+	args  string // e.g: "N", empty when the op takes no argument
+	valid func(args []string) bool
+}
+
+func (g opGrammar) usage(name string) string {
+	if g.args == "" {
+		return name
+	}
+	return name + ":" + g.args
+}
+
+func hasOp(ops map[string]opGrammar, name string) bool {
+	_, has := ops[name]
+	return has
+}
+
+func noArgs(args []string) bool { return len(args) == 0 }
+
+func countArg(args []string) bool {
+	n, ok := intArg(args)
+	return ok && n >= 0
+}
+
+var bare = opGrammar{valid: noArgs}
+
+var textOps = map[string]opGrammar{
+	"any": bare, "has_value": bare, "is_empty": bare, "eq": bare, "neq": bare, "regex": bare,
+	"start_with": bare, "end_with": bare, "contain": bare,
+	"not_contain": bare, "not_start_with": bare, "not_end_with": bare,
+	"edit_distance": {"N", countArg},
+	"similarity": {"ratio", func(args []string) bool {
+		f, ok := floatArgs(args)
+		return ok && len(f) == 1 && f[0] > 0 && f[0] <= 1
+	}},
+	"sounds_like":  bare,
+	"contain_word": bare, "not_contain_word": bare, "wildcard": bare, "not_wildcard": bare,
+	"in_set": bare, "not_in_set": bare,
+	"length_eq": {"N", countArg}, "length_gt": {"N", countArg}, "length_lt": {"N", countArg},
+	"contains_any": bare, "contains_all": bare, "contains_none": bare, "subset_of": bare, "equals_set": bare,
+	"size_eq": {"N", countArg}, "size_gt": {"N", countArg}, "size_lt": {"N", countArg},
+}
+
+var floatOps = map[string]opGrammar{
+	"has_value": bare, "is_empty": bare, "eq": bare, "neq": bare,
+	"gt": bare, "lt": bare, "gte": bare, "lte": bare, "in_range": bare, "not_in_range": bare,
+}
+
+var textTransforms = map[string]opGrammar{
+	"trim": bare, "lower_case": bare, "upper_case": bare,
+	"remove_spaces": bare, "strip_diacritics": bare, "collapse_whitespace": bare,
+	"normalize_email": bare, "email_domain": bare, "url_host": bare, "url_path": bare,
+	// normalize_phone keeps the digits, normalize_phone:e164 or
+	// normalize_phone:e164,1 converts to E.164 with a country code
+	"normalize_phone": {"e164[,N]", func(args []string) bool {
+		if len(args) == 0 {
+			return true
+		}
+		if strings.TrimSpace(args[0]) != "e164" || len(args) > 2 {
+			return false
+		}
+		return len(args) == 1 || countArg([]string{strings.TrimPrefix(strings.TrimSpace(args[1]), "+")})
+	}},
+	// the runes from start, negative from the end, and at most N of them
+	"substring": {"int[,N]", func(args []string) bool {
+		if len(args) == 0 || len(args) > 2 {
+			return false
+		}
+		for i, arg := range args {
+			n, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil || (i == 1 && n < 0) {
+				return false
+			}
+		}
+		return true
+	}},
+	// the int-th part split by text, negative from the end, e.g:
+	// split_part:-,2
+	"split_part": {"text,int", func(args []string) bool {
+		if len(args) < 2 || strings.Join(args[:len(args)-1], ",") == "" {
+			return false
+		}
+		n, ok := intArg(args[len(args)-1:])
+		return ok && n != 0
+	}},
+}
+
+var floatTransforms = map[string]opGrammar{
+	"abs": bare, "floor": bare, "ceil": bare, "log": bare, "log10": bare,
+	// round keeps N decimals, none when omitted
+	"round": {"[N]", func(args []string) bool { return len(args) == 0 || countArg(args) }},
+	"multiply": {"number", func(args []string) bool {
+		nums, ok := floatArgs(args)
+		return ok && len(nums) == 1
+	}},
+	"divide": {"number", func(args []string) bool {
+		nums, ok := floatArgs(args)
+		return ok && len(nums) == 1 && nums[0] != 0
+	}},
+	// clamp:min,max
+	"clamp": {"number,number", func(args []string) bool {
+		nums, ok := floatArgs(args)
+		return ok && len(nums) == 2 && nums[0] <= nums[1]
+	}},
+}
+
+var boolOps = map[string]opGrammar{"has_value": bare, "true": bare, "false": bare}
+
+var datetimeOps = map[string]opGrammar{
+	"any": bare, "unset": bare, "has_value": bare, "in_business_hour": bare, "non_business_hour": bare,
+	"today": bare, "yesterday": bare, "this_week": bare, "last_week": bare, "this_month": bare, "last_month": bare,
+	"this_quarter": bare, "last_quarter": bare, "this_year": bare, "last_year": bare,
+	"this_fiscal_quarter": bare, "last_fiscal_quarter": bare, "this_fiscal_year": bare, "last_fiscal_year": bare,
+	"date_last_30mins": bare, "date_last_2hours": bare, "date_last_24h": bare, "date_last_7days": bare, "date_last_30days": bare,
+	"last": bare, "before_ago": bare, "days_of_week": bare, "after": bare, "before": bare, "between": bare, "outside": bare,
+	"anniversary_today": bare,
+	// N days
+	"anniversary_in_next": {"N", countArg},
+	"month_is": {"month[,month...]", func(args []string) bool {
+		for _, arg := range args {
+			if _, ok := parseMonth(arg); !ok {
+				return false
+			}
+		}
+		return len(args) > 0
+	}},
+	"day_of_month_is": {"day[,day...]", func(args []string) bool {
+		for _, arg := range args {
+			if day, err := strconv.Atoi(strings.TrimSpace(arg)); err != nil || day < 1 || day > 31 {
+				return false
+			}
+		}
+		return len(args) > 0
+	}},
+	"tomorrow": bare, "next_week": bare, "next_month": bare,
+	// N seconds
+	"next": {"N", countArg}, "after_from_now": {"N", countArg},
+	// from,to, windows crossing midnight wrap, e.g: time_of_day:22:00,06:00
+	"time_of_day": {"clock,clock", func(args []string) bool {
+		if len(args) != 2 {
+			return false
+		}
+		_, ok1 := parseClock(args[0])
+		_, ok2 := parseClock(args[1])
+		return ok1 && ok2
+	}},
+	// N seconds of business hours
+	"business_hours_last": {"N", countArg}, "business_hours_before_ago": {"N", countArg},
+}
+
+// validateArgs reports args which do not follow the grammar of op
+func (v *validator) validateArgs(path, name string, grammar opGrammar, args []string) bool {
+	if grammar.valid(args) {
+		return true
+	}
+	if grammar.args == "" {
+		v.report(path, "%s takes no argument", name)
+	} else {
+		v.report(path, "invalid arguments for %s, want %s", name, grammar.usage(name))
+	}
+	return false
+}
+
+// ConditionError describes a problem in a UserViewCondition, Path locates the
+// offending node, e.g: $.all[0].one[2].text.op
+type ConditionError struct {
+	Path    string
+	Message string
+}
+
+func (e ConditionError) Error() string { return e.Path + ": " + e.Message }
+
+// ValidateCondition reports every problem found in cond which would make it
+// silently evaluate to true or false: unknown keys and ops, missing operands,
+// undefined attributes, malformed regexes and comparisons of mismatched types
+func ValidateCondition(defM map[string]*header.AttributeDefinition, cond *header.UserViewCondition) []ConditionError {
+	v := &validator{defM: defM}
+	v.validate("$", cond)
+	return v.errs
+}
+
+type validator struct {
+	defM map[string]*header.AttributeDefinition
+	errs []ConditionError
+}
+
+func (v *validator) report(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, ConditionError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) validate(path string, cond *header.UserViewCondition) {
+	if cond.GetKey() == NotKey {
+		if len(cond.GetOne()) == 0 && len(cond.GetAll()) == 0 {
+			// would never match
+			v.report(path, "not requires a condition in one or all")
+			return
+		}
+		v.validate(path, negated(cond))
+		return
+	}
+
+	if len(cond.GetOne()) > 0 {
+		for i, c := range cond.GetOne() {
+			v.validate(path+".one["+strconv.Itoa(i)+"]", c)
+		}
+		return
+	}
+
+	if len(cond.GetAll()) > 0 {
+		for i, c := range cond.GetAll() {
+			v.validate(path+".all["+strconv.Itoa(i)+"]", c)
+		}
+		return
+	}
+
+	key := cond.GetKey()
+	if key == "" {
+		return
+	}
+
+	if field, _ := compareOp(cond); field != "" {
+		if _, err := compileCompare(v.defM, cond); err != nil {
+			v.report(path+"."+field+".op", "%v", err)
+		}
+		return
+	}
+
+	accessor, err := ResolveKey(key, v.defM)
+	if err != nil {
+		v.report(path+".key", "%v", err)
+		return
+	}
+
+	switch accessor.Type {
+	case "keyword":
+		if _, has := keywordOperand(cond); !has {
+			v.report(path+".text.contain", "keyword requires a value")
+		}
+	case "list":
+		v.validateText(path+".text", cond.GetText())
+	case "text":
+		// texts may be compared as numbers or dates
+		if cond.GetText() == nil && cond.GetNumber() != nil {
+			v.validateFloat(path+".number", cond.GetNumber())
+		} else if cond.GetText() == nil && cond.GetDatetime() != nil {
+			v.validateDatetime(path+".datetime", cond.GetDatetime())
+		} else {
+			v.validateText(path+".text", cond.GetText())
+		}
+	case "number":
+		v.validateFloat(path+".number", cond.GetNumber())
+	case "boolean":
+		v.validateBool(path+".boolean", cond.GetBoolean())
+	case "datetime":
+		v.validateDatetime(path+".datetime", cond.GetDatetime())
+	default:
+		v.report(path+".key", "key %q has unsupported type %q", key, accessor.Type)
+	}
+}
+
+func (v *validator) validateText(path string, cond *header.TextCondition) {
+	if cond == nil {
+		v.report(path, "missing text condition")
+		return
+	}
+
+	_, _, op, _ := splitQuantifier(cond.GetOp())
+	op, args := splitOp(op)
+	grammar, has := textOps[op]
+	if !has {
+		v.report(path+".op", "unknown text op %q", op)
+		return
+	}
+
+	if v.validateArgs(path+".op", op, grammar, args) {
+		if _, err := newTextMatcher(cond); err != nil {
+			if op == "regex" {
+				v.report(path+".regex", "%v", err)
+			} else {
+				v.report(path+".op", "%v", err)
+			}
+		}
+	}
+
+	for i, transform := range cond.GetTransforms() {
+		name, args := splitOp(transform.GetName())
+		grammar, has := textTransforms[name]
+		if !has {
+			v.report(path+".transforms["+strconv.Itoa(i)+"]", "unknown text transform %q", name)
+			continue
+		}
+		v.validateArgs(path+".transforms["+strconv.Itoa(i)+"]", name, grammar, args)
+	}
+
+	// eq and neq without operands match everything
+	field := textOperandField(op)
+	if field != "" && op != "eq" && op != "neq" && len(textOperands(cond, field)) == 0 {
+		v.report(path+"."+field, "%s requires at least one value", op)
+	}
+}
+
+func (v *validator) validateFloat(path string, cond *header.FloatCondition) {
+	if cond == nil {
+		v.report(path, "missing number condition")
+		return
+	}
+
+	op, args := splitOp(cond.GetOp())
+	grammar, has := floatOps[op]
+	if !has {
+		v.report(path+".op", "unknown number op %q", op)
+		return
+	}
+	v.validateArgs(path+".op", op, grammar, args)
+
+	for i, transform := range cond.GetTransforms() {
+		name, args := splitOp(transform.GetName())
+		grammar, has := floatTransforms[name]
+		if !has {
+			v.report(path+".transforms["+strconv.Itoa(i)+"]", "unknown number transform %q", name)
+			continue
+		}
+		v.validateArgs(path+".transforms["+strconv.Itoa(i)+"]", name, grammar, args)
+	}
+
+	if op == "in_range" && len(cond.GetInRange()) < 2 {
+		v.report(path+".in_range", "in_range requires two values")
+	}
+	if op == "not_in_range" && len(cond.GetNotInRange()) < 2 {
+		v.report(path+".not_in_range", "not_in_range requires two values")
+	}
+}
+
+func (v *validator) validateBool(path string, cond *header.BoolCondition) {
+	if cond == nil {
+		v.report(path, "missing boolean condition")
+		return
+	}
+
+	op, args := splitOp(cond.GetOp())
+	grammar, has := boolOps[op]
+	if !has {
+		v.report(path+".op", "unknown boolean op %q", op)
+		return
+	}
+	v.validateArgs(path+".op", op, grammar, args)
+}
+
+func (v *validator) validateDatetime(path string, cond *header.DatetimeCondition) {
+	if cond == nil {
+		v.report(path, "missing datetime condition")
+		return
+	}
+
+	op, args := splitOp(cond.GetOp())
+	grammar, has := datetimeOps[op]
+	if !has {
+		v.report(path+".op", "unknown datetime op %q", op)
+		return
+	}
+	v.validateArgs(path+".op", op, grammar, args)
+
+	switch op {
+	case "between":
+		if len(cond.GetBetween()) != 2 {
+			v.report(path+".between", "between requires two bounds")
+		}
+	case "outside":
+		if len(cond.GetOutside()) != 2 {
+			v.report(path+".outside", "outside requires two bounds")
+		}
+	case "days_of_week":
+		if len(cond.GetDaysOfWeek()) == 0 {
+			v.report(path+".days_of_week", "days_of_week requires at least one day")
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package userutil
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/subiz/header"
+)
+
+var grammarDefM = map[string]*header.AttributeDefinition{
+	"score": {Key: "score", Type: "number"},
+	"vip":   {Key: "vip", Type: "boolean"},
+	"seen":  {Key: "seen", Type: "datetime"},
+}
+
+// grammarLeaf builds a leaf using op or transform name of kind, with every
+// operand the op requires
+func grammarLeaf(kind, name string) *header.UserViewCondition {
+	switch kind {
+	case "text", "text transform":
+		text := &header.TextCondition{Op: "eq", Eq: []string{"x"}}
+		if kind == "text transform" {
+			text.Transforms = []*header.TextTransform{{Name: name}}
+		} else {
+			text = &header.TextCondition{Op: name, Regex: "x", Eq: []string{"x"}, Neq: []string{"x"},
+				StartWith: []string{"x"}, EndWith: []string{"x"}, Contain: []string{"x"},
+				NotContain: []string{"x"}, NotStartWith: []string{"x"}}
+		}
+		return &header.UserViewCondition{Key: "id", Text: text}
+	case "number", "number transform":
+		number := &header.FloatCondition{Op: "gt", Gt: 1}
+		if kind == "number transform" {
+			number.Transforms = []*header.FloatTransform{{Name: name}}
+		} else {
+			number = &header.FloatCondition{Op: name, InRange: []float64{1, 2}, NotInRange: []float64{1, 2}}
+		}
+		return &header.UserViewCondition{Key: "attr:score", Number: number}
+	case "boolean":
+		return &header.UserViewCondition{Key: "attr:vip", Boolean: &header.BoolCondition{Op: name}}
+	}
+	return &header.UserViewCondition{Key: "attr:seen", Datetime: &header.DatetimeCondition{
+		Op: name, Between: []int64{1, 2}, Outside: []int64{1, 2}, DaysOfWeek: []string{"Monday"},
+	}}
+}
+
+// TestOpGrammar pins the arguments every op and transform accepts, see the
+// tables in validate.go
+func TestOpGrammar(t *testing.T) {
+	withArgs := map[string]struct{ valid, invalid []string }{
+		"text edit_distance":                 {[]string{"edit_distance:0", "edit_distance:2"}, []string{"edit_distance", "edit_distance:-1", "edit_distance:1.5", "edit_distance:1,2"}},
+		"text similarity":                    {[]string{"similarity:0.8", "similarity:1"}, []string{"similarity", "similarity:0", "similarity:1.2", "similarity:high"}},
+		"text length_eq":                     {[]string{"length_eq:0", "length_eq:10"}, []string{"length_eq", "length_eq:-1", "length_eq:x"}},
+		"text length_gt":                     {[]string{"length_gt:3"}, []string{"length_gt", "length_gt:3,4"}},
+		"text length_lt":                     {[]string{"length_lt:3"}, []string{"length_lt", "length_lt:2.5"}},
+		"text size_eq":                       {[]string{"size_eq:0"}, []string{"size_eq", "size_eq:-2"}},
+		"text size_gt":                       {[]string{"size_gt:1"}, []string{"size_gt"}},
+		"text size_lt":                       {[]string{"size_lt:1"}, []string{"size_lt:a"}},
+		"text transform normalize_phone":     {[]string{"normalize_phone", "normalize_phone:e164", "normalize_phone:e164,1", "normalize_phone:e164,+84"}, []string{"normalize_phone:e165", "normalize_phone:e164,x", "normalize_phone:e164,1,2"}},
+		"text transform substring":           {[]string{"substring:0", "substring:-3", "substring:1,3"}, []string{"substring", "substring:1.5", "substring:1,-1", "substring:1,2,3"}},
+		"text transform split_part":          {[]string{"split_part:-,1", "split_part:,,,-1", "split_part: ,2"}, []string{"split_part", "split_part:-", "split_part:-,0", "split_part:,1", "split_part:-,x"}},
+		"number transform round":             {[]string{"round", "round:2"}, []string{"round:-1", "round:1.5", "round:1,2"}},
+		"number transform multiply":          {[]string{"multiply:2", "multiply:-0.5"}, []string{"multiply", "multiply:x", "multiply:1,2"}},
+		"number transform divide":            {[]string{"divide:1000"}, []string{"divide", "divide:0", "divide:1,2"}},
+		"number transform clamp":             {[]string{"clamp:0,10", "clamp:-1,-1"}, []string{"clamp", "clamp:1", "clamp:10,0", "clamp:0,x"}},
+		"datetime anniversary_in_next":       {[]string{"anniversary_in_next:0", "anniversary_in_next:30"}, []string{"anniversary_in_next", "anniversary_in_next:-1", "anniversary_in_next:1,2"}},
+		"datetime month_is":                  {[]string{"month_is:1", "month_is:jan,December,12"}, []string{"month_is", "month_is:0", "month_is:13", "month_is:1,smarch"}},
+		"datetime day_of_month_is":           {[]string{"day_of_month_is:1", "day_of_month_is:15,31"}, []string{"day_of_month_is", "day_of_month_is:0", "day_of_month_is:32", "day_of_month_is:1,x"}},
+		"datetime next":                      {[]string{"next:0", "next:3600"}, []string{"next", "next:-1", "next:1h"}},
+		"datetime after_from_now":            {[]string{"after_from_now:60"}, []string{"after_from_now", "after_from_now:1.5"}},
+		"datetime time_of_day":               {[]string{"time_of_day:09:00,17:30", "time_of_day:22:00,06:00"}, []string{"time_of_day", "time_of_day:09:00", "time_of_day:9,17", "time_of_day:24:00,01:00", "time_of_day:09:00,17:00,18:00"}},
+		"datetime business_hours_last":       {[]string{"business_hours_last:3600"}, []string{"business_hours_last", "business_hours_last:-5"}},
+		"datetime business_hours_before_ago": {[]string{"business_hours_before_ago:0"}, []string{"business_hours_before_ago", "business_hours_before_ago:x"}},
+	}
+
+	tables := map[string]map[string]opGrammar{
+		"text": textOps, "number": floatOps, "boolean": boolOps, "datetime": datetimeOps,
+		"text transform": textTransforms, "number transform": floatTransforms,
+	}
+	for kind, table := range tables {
+		for name, grammar := range table {
+			cases, has := withArgs[kind+" "+name]
+			if grammar.args == "" {
+				// ops without arguments reject any
+				cases = struct{ valid, invalid []string }{[]string{name}, []string{name + ":1", name + ":"}}
+			} else if !has {
+				t.Errorf("%s %s takes %s, add it to the grammar cases", kind, name, grammar.usage(name))
+				continue
+			}
+
+			for _, op := range cases.valid {
+				if errs := ValidateCondition(grammarDefM, grammarLeaf(kind, op)); len(errs) > 0 {
+					t.Errorf("%s %s: want valid, got %v", kind, op, errs)
+				}
+			}
+			for _, op := range cases.invalid {
+				errs := ValidateCondition(grammarDefM, grammarLeaf(kind, op))
+				if len(errs) == 0 {
+					t.Errorf("%s %s: want invalid", kind, op)
+				} else if !strings.Contains(errs[0].Message, name) {
+					t.Errorf("%s %s: want the error to name %s, got %v", kind, op, name, errs)
+				}
+			}
+		}
+	}
+}
+
+func TestQuantifierGrammar(t *testing.T) {
+	for op, valid := range map[string]bool{
+		"any/eq": true, "all/eq": true, "none/contain": true, "exactly:2/eq": true, "at_least:0/has_value": true,
+		"exactly/eq": false, "exactly:-1/eq": false, "at_least:x/eq": false, "any:1/eq": false, "most/eq": false,
+		"all/eq:1": false, "all/contains_all": false,
+	} {
+		cond := &header.UserViewCondition{Key: "labels", Text: &header.TextCondition{Op: op, Eq: []string{"x"}, Contain: []string{"x"}}}
+		if got := len(ValidateCondition(nil, cond)) == 0; got != valid {
+			t.Errorf("%s: valid %v, want %v", op, got, valid)
+		}
+	}
+}
+
+func TestValidateNot(t *testing.T) {
+	leaf := &header.UserViewCondition{Key: "id", Text: &header.TextCondition{Op: "eq", Eq: []string{"u1"}}}
+	cases := map[string]*header.UserViewCondition{
+		"":                 {Key: NotKey, All: []*header.UserViewCondition{leaf}},
+		"$":                {Key: NotKey},
+		"$.all[1]":         {All: []*header.UserViewCondition{leaf, {Key: NotKey}}},
+		"$.one[0].text.op": {Key: NotKey, One: []*header.UserViewCondition{{Key: "id", Text: &header.TextCondition{Op: "eqq"}}}},
+	}
+	for want, cond := range cases {
+		errs := ValidateCondition(nil, cond)
+		if want == "" {
+			if len(errs) > 0 {
+				t.Errorf("want valid, got %v", errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || errs[0].Path != want {
+			t.Errorf("want an error at %s, got %v", want, errs)
+		}
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	defM := map[string]*header.AttributeDefinition{
+		"name":  {Key: "name", Type: "text"},
+		"score": {Key: "score", Type: "number"},
+		"seen":  {Key: "seen", Type: "datetime"},
+		"photo": {Key: "photo", Type: "blob"},
+	}
+	name := &header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Eq: []string{"lan"}}}
+	cases := []struct {
+		cond    *header.UserViewCondition
+		path    string
+		message string
+	}{
+		// keys
+		{&header.UserViewCondition{Key: "nickname", Text: &header.TextCondition{Op: "has_value"}}, "$.key", `unknown key "nickname"`},
+		{&header.UserViewCondition{Key: "attr:age", Number: &header.FloatCondition{Op: "gt"}}, "$.key", `attribute "age" is not defined`},
+		{&header.UserViewCondition{Key: "attr:photo", Text: &header.TextCondition{Op: "has_value"}}, "$.key", `unsupported type "blob"`},
+
+		// ops and their conditions
+		{&header.UserViewCondition{Key: "attr:name"}, "$.text", "missing text condition"},
+		{&header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "equal"}}, "$.text.op", `unknown text op "equal"`},
+		{&header.UserViewCondition{Key: "attr:score", Number: &header.FloatCondition{Op: "above"}}, "$.number.op", `unknown number op "above"`},
+		{&header.UserViewCondition{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "yesterdays"}}, "$.datetime.op", `unknown datetime op "yesterdays"`},
+		{&header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "eq", Transforms: []*header.TextTransform{{Name: "upper"}}}}, "$.text.transforms[0]", `unknown text transform "upper"`},
+
+		// missing operands
+		{&header.UserViewCondition{Key: "attr:score", Number: &header.FloatCondition{Op: "in_range", InRange: []float64{1}}}, "$.number.in_range", "in_range requires two values"},
+		{&header.UserViewCondition{Key: "attr:score", Number: &header.FloatCondition{Op: "not_in_range"}}, "$.number.not_in_range", "not_in_range requires two values"},
+		{&header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "contain"}}, "$.text.contain", "contain requires at least one value"},
+		{&header.UserViewCondition{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "between", Between: []int64{1}}}, "$.datetime.between", "between requires two bounds"},
+		{&header.UserViewCondition{Key: "attr:seen", Datetime: &header.DatetimeCondition{Op: "days_of_week"}}, "$.datetime.days_of_week", "days_of_week requires at least one day"},
+		{&header.UserViewCondition{Key: "keyword", Text: &header.TextCondition{Op: "contain"}}, "$.text.contain", "keyword requires a value"},
+
+		// regexes
+		{&header.UserViewCondition{Key: "attr:name", Text: &header.TextCondition{Op: "regex", Regex: "(lan"}}, "$.text.regex", "invalid regex"},
+
+		// comparisons
+		{&header.UserViewCondition{Key: "attr:name", Number: &header.FloatCondition{Op: "compare:gt,attr:score"}}, "$.number.op", `cannot compare text "attr:name" with number "attr:score"`},
+
+		// nested nodes are located by their index
+		{&header.UserViewCondition{All: []*header.UserViewCondition{name, {One: []*header.UserViewCondition{name, {Key: "attr:age", Text: &header.TextCondition{Op: "has_value"}}}}}}, "$.all[1].one[1].key", `attribute "age" is not defined`},
+	}
+
+	for _, c := range cases {
+		errs := ValidateCondition(defM, c.cond)
+		if len(errs) != 1 {
+			t.Errorf("want an error at %s, got %v", c.path, errs)
+			continue
+		}
+		if errs[0].Path != c.path || !strings.Contains(errs[0].Message, c.message) {
+			t.Errorf("want %s: %s, got %v", c.path, c.message, errs[0])
+		}
+		if errs[0].Error() != errs[0].Path+": "+errs[0].Message {
+			t.Errorf("want the path in the error, got %q", errs[0].Error())
+		}
+	}
+
+	// every problem is reported
+	cond := &header.UserViewCondition{One: []*header.UserViewCondition{
+		{Key: "nickname", Text: &header.TextCondition{Op: "has_value"}},
+		name,
+		{Key: "attr:score", Number: &header.FloatCondition{Op: "in_range"}},
+	}}
+	errs := ValidateCondition(defM, cond)
+	if len(errs) != 2 || errs[0].Path != "$.one[0].key" || errs[1].Path != "$.one[2].number.in_range" {
+		t.Errorf("want errors at $.one[0].key and $.one[2].number.in_range, got %v", errs)
+	}
+	if errs := ValidateCondition(defM, name); len(errs) > 0 {
+		t.Errorf("want valid, got %v", errs)
+	}
+}
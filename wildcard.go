@@ -0,0 +1,67 @@
+package userutil
+
+import (
+	"regexp"
+	"strings"
+)
+
+// matchPattern tells whether str contains one of the operand words
+// (contain_word) or matches one of the operand globs (wildcard)
+func (m *textMatcher) matchPattern(str string) bool {
+	if len(m.globs) > 0 {
+		for _, re := range m.globs {
+			if re.MatchString(str) {
+				return true
+			}
+		}
+		return false
+	}
+
+	tokens := tokenize(str)
+	for _, words := range m.words {
+		if containsWords(tokens, words) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsWords tells whether words appear in tokens as a whole, in order
+// and next to each other: "van anh" is in "nguyen van anh" but "an" is not
+func containsWords(tokens, words []string) bool {
+	if len(words) == 0 {
+		return false
+	}
+	for i := 0; i+len(words) <= len(tokens); i++ {
+		found := true
+		for j, word := range words {
+			if tokens[i+j] != word {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegex converts a wildcard pattern where * matches any text and ?
+// matches a single character, e.g: *@*.edu.vn, to an anchored regex
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, ch := range glob {
+		switch ch {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package userutil
+
+import (
+	"testing"
+
+	"github.com/subiz/header"
+)
+
+func TestWildcard(t *testing.T) {
+	cases := []struct {
+		value, glob string
+		want        bool
+	}{
+		// * matches any text, empty included, ? a single character
+		{"lan@hcmus.edu.vn", "*@*.edu.vn", true},
+		{"lan@hcmus.edu.vn.com", "*@*.edu.vn", false},
+		{"@.edu.vn", "*@*.edu.vn", true},
+		{"ab12", "ab??", true},
+		{"ab1", "ab??", false},
+		{"ab123", "ab??", false},
+		{"đức", "?ức", true},
+		{"line\nbreak", "line*", true},
+		{"line\nbreak", "line?break", true},
+
+		// patterns are anchored and their other characters are literal
+		{"xabc", "abc", false},
+		{"abc", "a.c", false},
+		{"a.c", "a.c", true},
+		{"a+b", "a+b", true},
+		{"aab", "a+b", false},
+		{"(x)", "(x)", true},
+		{"[ab]", "[ab]", true},
+		{"a", "[ab]", false},
+		{`c:\tmp`, `c:\*`, true},
+		{"^$", "^$", true},
+		{"a|b", "a|b", true},
+		{"a", "a|b", false},
+		{"", "*", true},
+		{"", "?", false},
+	}
+
+	for _, c := range cases {
+		cond := &header.TextCondition{Op: "wildcard", Eq: []string{c.glob}, CaseSensitive: true, AccentSensitive: true}
+		if got := EvaluateText(true, c.value, cond); got != c.want {
+			t.Errorf("%q wildcard %q: got %v, want %v", c.value, c.glob, got, c.want)
+		}
+		cond.Op, cond.Neq, cond.Eq = "not_wildcard", cond.Eq, nil
+		if got := EvaluateText(true, c.value, cond); got == c.want {
+			t.Errorf("%q not_wildcard %q: got %v, want %v", c.value, c.glob, got, !c.want)
+		}
+	}
+
+	// values and patterns are folded unless the condition is sensitive
+	cond := &header.TextCondition{Op: "wildcard", Eq: []string{"NGUY?N *"}}
+	if !EvaluateText(true, "Nguyễn Văn A", cond) {
+		t.Error("want a folded match")
+	}
+	cond.CaseSensitive = true
+	if EvaluateText(true, "Nguyễn Văn A", cond) {
+		t.Error("want no case sensitive match")
+	}
+}
+
+func TestContainWord(t *testing.T) {
+	cases := []struct {
+		value, word     string
+		accentSensitive bool
+		want            bool
+	}{
+		{"Nguyễn Văn Anh", "anh", false, true},
+		{"Nguyễn Văn Anh", "an", false, false},
+		{"Nguyễn Văn Anh", "van anh", false, true},
+		{"Nguyễn Văn Anh", "anh van", false, false},
+		{"Nguyễn Văn Anh", "nguyen", false, true},
+
+		// accented letters are part of the word, not boundaries
+		{"Nguyễn Văn Anh", "văn", true, true},
+		{"Nguyễn Văn Anh", "van", true, false},
+		{"Nguyễn Văn Anh", "v", true, false},
+		{"Nguyễn Văn Anh", "nguy", true, false},
+		{"Đặng Thị Ánh", "ánh", true, true},
+		{"Đặng Thị Ánh", "đặng thị", true, true},
+
+		// punctuation and digits
+		{"nguyen-van.anh@acme.com", "anh", false, true},
+		{"nguyen-van.anh@acme.com", "acme com", false, true},
+		{"order #1234, paid", "1234", false, true},
+		{"order #1234, paid", "123", false, false},
+		{"", "anh", false, false},
+	}
+
+	for _, c := range cases {
+		cond := &header.TextCondition{Op: "contain_word", Contain: []string{c.word}, AccentSensitive: c.accentSensitive}
+		if got := EvaluateText(true, c.value, cond); got != c.want {
+			t.Errorf("%q contain_word %q: got %v, want %v", c.value, c.word, got, c.want)
+		}
+		cond.Op, cond.NotContain, cond.Contain = "not_contain_word", cond.Contain, nil
+		if got := EvaluateText(true, c.value, cond); got == c.want {
+			t.Errorf("%q not_contain_word %q: got %v, want %v", c.value, c.word, got, !c.want)
+		}
+	}
+}